@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+	"github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+// `smuggler builtins`: Lists the builtin commands, which can be used
+// with `commands.<action>: {builtin: <name>, with: {...}}`
+func builtinsMain(args []string) {
+	if len(args) > 0 {
+		utils.Sayf("usage: %s builtins\n", os.Args[0])
+		os.Exit(1)
+	}
+	for _, name := range smuggler.BuiltinNames() {
+		builtin, _ := smuggler.FindBuiltin(name)
+		fmt.Printf("%s: %s\n", name, builtin.Description)
+
+		argNames := make([]string, 0, len(builtin.Args))
+		for arg := range builtin.Args {
+			argNames = append(argNames, arg)
+		}
+		sort.Strings(argNames)
+		for _, arg := range argNames {
+			fmt.Printf("    with.%s: %s\n", arg, builtin.Args[arg])
+		}
+	}
+}
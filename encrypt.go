@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+	"github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+// `smuggler encrypt [value]`: Encrypts a value, or stdin, so that
+// it can be used safely in `source` or `params`
+func encryptMain(args []string) {
+	flags := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	keyFile := flags.String("key-file", os.Getenv(smuggler.DecryptionKeyFileEnv),
+		"File with the key, by default "+smuggler.DecryptionKeyFileEnv)
+	publicKeyFile := flags.String("public-key-file", "", "File with the public key of the key, to encrypt without the key")
+	generateKey := flags.Bool("generate-key", false, "Print a new random key and exit")
+	printPublicKey := flags.Bool("print-public-key", false, "Print the public key of the key and exit")
+	flags.Usage = func() {
+		utils.Sayf("usage: %s encrypt [-key-file <file>] [value]\n", os.Args[0])
+		utils.Sayf("       %s encrypt -public-key-file <file> [value]\n", os.Args[0])
+		utils.Sayf("       %s encrypt -generate-key\n", os.Args[0])
+		utils.Sayf("       %s encrypt -key-file <file> -print-public-key\n\n", os.Args[0])
+		utils.Sayf("Encrypts the value, or stdin if missing, with the key or its public key.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *generateKey {
+		key, err := smuggler.GenerateEncryptionKey()
+		if err != nil {
+			utils.Fatal("generating key", err, 1)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	// Encrypting with the public key does not need the key
+	encrypt := smuggler.EncryptValue
+	path := *keyFile
+	if *publicKeyFile != "" && !*printPublicKey {
+		encrypt = smuggler.SealValue
+		path = *publicKeyFile
+	}
+	if path == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	key, err := smuggler.ReadEncryptionKeyFile(path)
+	if err != nil {
+		utils.Fatal("reading key", err, 1)
+	}
+
+	if *printPublicKey {
+		publicKey, err := smuggler.PublicKey(key)
+		if err != nil {
+			utils.Fatal("computing the public key", err, 1)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(publicKey))
+		return
+	}
+
+	var value string
+	if flags.NArg() > 0 {
+		value = flags.Arg(0)
+	} else {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			utils.Fatal("reading value from stdin", err, 1)
+		}
+		value = string(b)
+	}
+
+	encrypted, err := encrypt(key, value)
+	if err != nil {
+		utils.Fatal("encrypting value", err, 1)
+	}
+	fmt.Println(encrypted)
+}
@@ -0,0 +1,37 @@
+// Example of a resource implemented in go with the smuggler library.
+// It reports the current time as version and writes it into a file.
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+type timeResource struct{}
+
+func (timeResource) Check(ctx context.Context, request *smuggler.ResourceRequest) ([]smuggler.Version, error) {
+	smuggler.LoggerFromContext(ctx).Printf("[INFO] checking the time")
+	return []smuggler.Version{{"time": time.Now().UTC().Format(time.RFC3339)}}, nil
+}
+
+func (timeResource) In(ctx context.Context, dir string, request *smuggler.ResourceRequest) (*smuggler.ResourceResponse, error) {
+	err := ioutil.WriteFile(filepath.Join(dir, "time"), []byte(request.Version["time"]), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &smuggler.ResourceResponse{Version: request.Version}, nil
+}
+
+func (timeResource) Out(ctx context.Context, dir string, request *smuggler.ResourceRequest) (*smuggler.ResourceResponse, error) {
+	return &smuggler.ResourceResponse{
+		Version: smuggler.Version{"time": time.Now().UTC().Format(time.RFC3339)},
+	}, nil
+}
+
+func main() {
+	smuggler.Main(timeResource{})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+	"github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+// `smuggler explain`: Prints what an action would run for the request in
+// stdin, with the resolved config and params, without running anything
+func explainMain(args []string) {
+	defer utils.PrintRecover()
+
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("SMUGGLER_CONFIG"), "smuggler.yml to merge into the source")
+	flags.Usage = func() {
+		utils.Sayf("usage: %s explain [-config <file>] check|in|out [dir] < request.json\n\n", os.Args[0])
+		utils.Sayf("Prints the command, params and stdin of the action for the request,\n")
+		utils.Sayf("without running it. The directory is the current one by default.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	action := flags.Arg(0)
+	requestType := smuggler.RequestType(action)
+	switch requestType {
+	case smuggler.CheckType, smuggler.InType, smuggler.OutType:
+	default:
+		utils.Fatal("parsing arguments", smuggler.UnknownActionError(action), 1)
+	}
+	dataDir := ""
+	if requestType != smuggler.CheckType {
+		dataDir = "."
+		if flags.NArg() == 2 {
+			dataDir = flags.Arg(1)
+		}
+	}
+
+	input, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		utils.Fatal("reading request from stdin", err, 1)
+	}
+
+	os.Setenv("SMUGGLER_CONFIG", *configPath)
+	logger := smuggler.OpenSmugglerLog().Logger
+	configFile := smuggler.FindSmugglerConfig(logger)
+	request := smuggler.ParseInputAndConfig(requestType, input, smuggler.ReadSmugglerConfig(configFile))
+	request.ConfigFile = configFile
+
+	command := smuggler.NewSmugglerCommand(logger)
+	command.DryRun = true
+	response, err := command.RunAction(dataDir, request)
+	if command.Explanation != nil {
+		fmt.Print(command.Explanation)
+	}
+	if err != nil {
+		utils.Fatal("explaining action", err, 1)
+	}
+
+	var output interface{} = response
+	if requestType == smuggler.CheckType {
+		output = response.Versions
+	}
+	b, err := json.Marshal(output)
+	if err != nil {
+		utils.Fatal("encoding response", err, 1)
+	}
+	fmt.Printf("Response:\n  %s\n", b)
+}
@@ -0,0 +1,5 @@
+#!/bin/bash
+set -e -u
+cp "${SMUGGLER_SOURCES_DIR}/${SMUGGLER_traget_file}" "${SMUGGLER_OUTPUT_DIR}/"
+echo "${SMUGGLER_DESTINATION_DIR:-none}"
+echo "${SMUGGLER_target_file}" > "${SMUGGLER_OUTPUT_DIR}/versions"
@@ -97,7 +97,7 @@ func Copy(src, dst string) error {
 // List the json tag names (`json:"name,opts"`)   of a struct
 func ListJsonTagsOfStruct(x interface{}) []string {
 	v := reflect.TypeOf(x)
-	tags := make([]string, v.NumField())
+	tags := make([]string, 0, v.NumField())
 
 	for i := 0; i < v.NumField(); i++ {
 		t := v.Field(i).Tag.Get("json")
@@ -161,3 +161,8 @@ func JsonPrettyPrint(in []byte) []byte {
 	}
 	return out.Bytes()
 }
+
+// Quote a string with single quotes for a POSIX shell
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+	"github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+// `smuggler lint`: Checks the SMUGGLER_ variables used by the commands of
+// the resources of a pipeline against the params of each action and step
+func lintMain(args []string) {
+	defer utils.PrintRecover()
+
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	pipelinePath := flags.String("pipeline", "", "Pipeline file with the resources")
+	configPath := flags.String("config", "", "smuggler.yml to merge into the source")
+	resourceType := flags.String("type", "", "Type of the resources to lint, the ones with `commands` by default")
+	scriptsDir := flags.String("scripts", "", "Directory of the relative script paths, the one of the pipeline by default")
+	flags.Usage = func() {
+		utils.Sayf("usage: %s lint -pipeline <file> [-config <file>] [-type <type>] [-scripts <dir>]\n\n", os.Args[0])
+		utils.Sayf("Reports the variables used by the commands which are not defined for\n")
+		utils.Sayf("the action, and the params which are not used.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *pipelinePath == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *scriptsDir == "" {
+		*scriptsDir = filepath.Dir(*pipelinePath)
+	}
+
+	pipeline, err := smuggler.LoadPipeline(*pipelinePath)
+	if err != nil {
+		utils.Fatal("loading pipeline", err, 1)
+	}
+	issues, err := smuggler.LintPipeline(pipeline, smuggler.ReadSmugglerConfig(*configPath), *resourceType, *scriptsDir)
+	if err != nil {
+		utils.Fatal("linting pipeline", err, 1)
+	}
+
+	failed := 0
+	for _, issue := range issues {
+		fmt.Println(issue)
+		if issue.IsError() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d errors, %d warnings\n", failed, len(issues)-failed)
+		os.Exit(1)
+	}
+}
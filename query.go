@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+	"github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+// `smuggler query <query> [file]`: Runs a query with the syntax of jq on the
+// JSON documents in the file or stdin, for the simple uses of jq in scripts
+func queryMain(args []string) {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	raw := flags.Bool("r", false, "Print strings without quotes")
+	compact := flags.Bool("c", false, "Print compact JSON instead of indented")
+	exitStatus := flags.Bool("e", false, "Exit with 1 if the last output is false or null")
+	flags.Usage = func() {
+		utils.Sayf("usage: %s query [-r] [-c] [-e] <query> [file]\n\n", os.Args[0])
+		utils.Sayf("Runs the query on the JSON in the file, or stdin if missing.\n")
+		utils.Sayf("Supports only a subset of the jq syntax, not jq itself: no variables,\n")
+		utils.Sayf("reduce, def, assignments, string interpolation or formats. See the\n")
+		utils.Sayf("\"Querying JSON\" section of the README for the supported syntax.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	query, err := smuggler.CompileQuery(flags.Arg(0))
+	if err != nil {
+		utils.Fatal("compiling query", err, 1)
+	}
+
+	input := io.Reader(os.Stdin)
+	if flags.NArg() == 2 {
+		f, err := os.Open(flags.Arg(1))
+		if err != nil {
+			utils.Fatal("opening input", err, 1)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	var last interface{}
+	decoder := json.NewDecoder(input)
+	for {
+		var doc interface{}
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			utils.Fatal("parsing input", err, 1)
+		}
+		outputs, err := query.Run(doc)
+		if err != nil {
+			utils.Fatal("running query", err, 1)
+		}
+		for _, o := range outputs {
+			printQueryOutput(o, *raw, *compact)
+			last = o
+		}
+	}
+
+	if *exitStatus && (last == nil || last == false) {
+		os.Exit(1)
+	}
+}
+
+func printQueryOutput(v interface{}, raw bool, compact bool) {
+	if s, ok := v.(string); ok && raw {
+		fmt.Println(s)
+		return
+	}
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if !compact {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(v); err != nil {
+		utils.Fatal("writing output", err, 1)
+	}
+	os.Stdout.Write(b.Bytes())
+}
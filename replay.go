@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+	"github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+// `smuggler replay`: Runs again the invocations recorded with
+// SMUGGLER_RECORD_DIR and compares the responses
+func replayMain(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.Usage = func() {
+		utils.Sayf("usage: %s replay <recording.json>...\n\n", os.Args[0])
+		utils.Sayf("Runs the recorded invocations and compares the responses.\n")
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		utils.Fatal("finding the smuggler binary", err, 1)
+	}
+
+	failed := false
+	for _, path := range flags.Args() {
+		recording, err := smuggler.LoadRecording(path)
+		if err != nil {
+			utils.Fatal("loading recording", err, 1)
+		}
+		result, err := recording.Replay(binary)
+		if err != nil {
+			utils.Fatal("replaying "+path, err, 1)
+		}
+		if recording.Matches(result) {
+			fmt.Printf("OK   %s\n", path)
+			continue
+		}
+		failed = true
+		fmt.Printf("DIFF %s\n", path)
+		fmt.Printf("  recorded: exit status %d, response %s\n", recording.ExitStatus, recording.Response)
+		fmt.Printf("  replayed: exit status %d, response %s\n", result.ExitStatus, result.Response)
+		fmt.Printf("  diff (- recorded, + replayed):\n")
+		for _, line := range recording.Diff(result) {
+			fmt.Printf("    %s\n", line)
+		}
+		if result.Stderr != "" {
+			fmt.Printf("  stderr:\n%s\n", result.Stderr)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
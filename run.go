@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+	"github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+// `smuggler run`: Runs an action of a resource of a pipeline locally, with
+// the request that concourse would send
+func runMain(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	pipelinePath := flags.String("pipeline", "", "Pipeline file with the resource")
+	resourceName := flags.String("resource", "", "Name of the resource in the pipeline")
+	jobName := flags.String("job", "", "Job with the get or put step of the resource, for its params")
+	version := flags.String("version", "", "Version for check and in, as JSON or as the value of `ID`")
+	dataDir := flags.String("dir", "", "Destination or sources directory for in and out, a temporary one by default")
+	configPath := flags.String("config", os.Getenv("SMUGGLER_CONFIG"), "smuggler.yml to merge into the source")
+	flags.Usage = func() {
+		utils.Sayf("usage: %s run -pipeline <file> -resource <name> [-job <name>] [-version <version>] [-dir <dir>] check|in|out\n\n", os.Args[0])
+		utils.Sayf("Runs the action of the resource with the request built from the pipeline.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	// Allow the flags after the action too
+	var action string
+	if flags.NArg() > 0 {
+		action = flags.Arg(0)
+		flags.Parse(flags.Args()[1:])
+	}
+	if *pipelinePath == "" || *resourceName == "" || action == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	requestType := smuggler.RequestType(action)
+	switch requestType {
+	case smuggler.CheckType, smuggler.InType, smuggler.OutType:
+	default:
+		utils.Fatal("parsing arguments", smuggler.UnknownActionError(action), 1)
+	}
+
+	pipeline, err := smuggler.LoadPipeline(*pipelinePath)
+	if err != nil {
+		utils.Fatal("loading pipeline", err, 1)
+	}
+	var v smuggler.Version
+	if *version != "" {
+		v = *smuggler.NewVersion(*version)
+	}
+	request, err := pipeline.Request(requestType, *resourceName, *jobName, v)
+	if err != nil {
+		utils.Fatal("building request", err, 1)
+	}
+	input, err := json.Marshal(request)
+	if err != nil {
+		utils.Fatal("building request", err, 1)
+	}
+
+	if requestType != smuggler.CheckType && *dataDir == "" {
+		*dataDir, err = ioutil.TempDir("", "smuggler-"+action)
+		if err != nil {
+			utils.Fatal("creating directory", err, 1)
+		}
+		utils.Sayf("Using directory %s\n", *dataDir)
+	}
+	os.Setenv("SMUGGLER_CONFIG", *configPath)
+
+	smuggler.MainWithRequest(smuggler.CommandResource{}, requestType, *dataDir, input)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+	"github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+// `smuggler simulate`: Runs check of a resource of a pipeline repeatedly,
+// as concourse does, reporting the new versions and the regressions
+func simulateMain(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	pipelinePath := flags.String("pipeline", "", "Pipeline file with the resource")
+	resourceName := flags.String("resource", "", "Name of the resource in the pipeline")
+	jobName := flags.String("job", "", "Job with the get step of the resource, for the params of in")
+	iterations := flags.Int("iterations", 1, "Number of checks to run")
+	historyPath := flags.String("history", "", "JSON file to keep the versions between runs")
+	runIn := flags.Bool("in", false, "Run in for every new version")
+	dataDir := flags.String("dir", "", "Directory for the new versions fetched with -in, a temporary one by default")
+	configPath := flags.String("config", os.Getenv("SMUGGLER_CONFIG"), "smuggler.yml to merge into the source")
+	flags.Usage = func() {
+		utils.Sayf("usage: %s simulate -pipeline <file> -resource <name> [-iterations <n>] [-history <file>] [-in [-job <name>] [-dir <dir>]]\n\n", os.Args[0])
+		utils.Sayf("Runs check repeatedly with the newest version, as concourse does.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *pipelinePath == "" || *resourceName == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	pipeline, err := smuggler.LoadPipeline(*pipelinePath)
+	if err != nil {
+		utils.Fatal("loading pipeline", err, 1)
+	}
+	history := &smuggler.VersionHistory{}
+	if *historyPath != "" {
+		if history, err = smuggler.LoadVersionHistory(*historyPath); err != nil {
+			utils.Fatal("loading history", err, 1)
+		}
+	}
+	if *runIn && *dataDir == "" {
+		if *dataDir, err = ioutil.TempDir("", "smuggler-simulate"); err != nil {
+			utils.Fatal("creating directory", err, 1)
+		}
+	}
+	if !*runIn {
+		*dataDir = ""
+	}
+
+	os.Setenv("SMUGGLER_CONFIG", *configPath)
+	logger := smuggler.OpenSmugglerLog().Logger
+	config := smuggler.FindAndReadSmugglerConfig(logger)
+
+	simulation := &smuggler.Simulation{
+		Resource: smuggler.CommandResource{},
+		Request: func(requestType smuggler.RequestType, version smuggler.Version) (*smuggler.ResourceRequest, error) {
+			request, err := pipeline.Request(requestType, *resourceName, *jobName, version)
+			if err != nil {
+				return nil, err
+			}
+			input, err := json.Marshal(request)
+			if err != nil {
+				return nil, err
+			}
+			return smuggler.ParseInputAndConfig(requestType, input, config), nil
+		},
+		History: history,
+		InDir:   *dataDir,
+	}
+
+	failed := false
+	ctx := smuggler.ContextWithLogger(context.Background(), logger)
+	err = simulation.Run(ctx, *iterations, func(iteration *smuggler.SimulationIteration) {
+		current := "no version"
+		if iteration.Current != nil {
+			current = smuggler.InterfaceToJsonString(iteration.Current)
+		}
+		fmt.Printf("check #%d from %s: %d versions, %d new\n",
+			iteration.Number, current, len(iteration.Versions), len(iteration.New))
+		for i, v := range iteration.New {
+			fmt.Printf("  new: %s\n", smuggler.InterfaceToJsonString(v))
+			if i < len(iteration.InDirs) {
+				fmt.Printf("  in:  %s\n", iteration.InDirs[i])
+			}
+		}
+		for _, r := range iteration.Regressions {
+			fmt.Printf("  regression: %s\n", r)
+			failed = true
+		}
+		if *historyPath != "" {
+			if err := history.Save(*historyPath); err != nil {
+				utils.Fatal("saving history", err, 1)
+			}
+		}
+	})
+	if err != nil {
+		utils.Fatal("simulating", err, 1)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
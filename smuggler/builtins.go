@@ -0,0 +1,151 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A command implemented in go and compiled into the binary, used with
+// `commands.<action>: {builtin: <name>, with: {...}}`. It gets the same
+// params, environment and stdin as an external command, and its output is
+// parsed the same way.
+type Builtin struct {
+	Description string
+	// Accepted arguments in `with` and their description
+	Args map[string]string
+	Run  func(ctx *BuiltinContext) error
+}
+
+type BuiltinContext struct {
+	// Arguments from `with`
+	With map[string]interface{}
+	// The params passed to commands as SMUGGLER_* variables, by name,
+	// e.g. `ACTION`, `OUTPUT_DIR` or `VERSION_JSON`
+	Params map[string]interface{}
+	// The environment an external command would get
+	Env    []string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Returns a param as it would be in the environment
+func (ctx *BuiltinContext) Param(name string) string {
+	v, ok := ctx.Params[name]
+	if !ok {
+		return ""
+	}
+	return InterfaceToJsonString(v)
+}
+
+// Returns an argument from `with`, or the default value if missing
+func (ctx *BuiltinContext) Arg(name string, defaultValue string) string {
+	v, ok := ctx.With[name]
+	if !ok || v == nil {
+		return defaultValue
+	}
+	return InterfaceToJsonString(v)
+}
+
+// Writes a JSON response to stdout
+func (ctx *BuiltinContext) Respond(v interface{}) error {
+	return json.NewEncoder(ctx.Stdout).Encode(v)
+}
+
+var registeredBuiltins = map[string]Builtin{
+	"noop": {
+		Description: "Does nothing. e.g. for an `in` which does not need to fetch anything",
+		Run:         func(ctx *BuiltinContext) error { return nil },
+	},
+	"version": {
+		Description: "Reports the version in `with.version`, or the version of the request",
+		Args: map[string]string{
+			"version": "Version to report, a map of strings",
+		},
+		Run: runVersionBuiltin,
+	},
+	"timestamp": {
+		Description: "Reports the current time as version, e.g. to trigger jobs periodically",
+		Args: map[string]string{
+			"key":    "Key of the version, by default `timestamp`",
+			"format": "Go time layout, by default RFC3339: `2006-01-02T15:04:05Z07:00`",
+		},
+		Run: runTimestampBuiltin,
+	},
+	"write_file": {
+		Description: "Writes `with.content` to `with.path`, relative to the destination or sources directory",
+		Args: map[string]string{
+			"path":    "Path of the file",
+			"content": "Content of the file",
+		},
+		Run: runWriteFileBuiltin,
+	},
+}
+
+// Register a builtin available in all the requests, for instance
+// from a resource implemented in go
+func RegisterBuiltin(name string, builtin Builtin) {
+	registeredBuiltins[name] = builtin
+}
+
+func FindBuiltin(name string) (Builtin, bool) {
+	b, ok := registeredBuiltins[name]
+	return b, ok
+}
+
+// Names of the registered builtins, sorted
+func BuiltinNames() []string {
+	names := make([]string, 0, len(registeredBuiltins))
+	for name := range registeredBuiltins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Responds with the version, as a list for check
+func respondVersion(ctx *BuiltinContext, version interface{}) error {
+	if ctx.Param("ACTION") == string(CheckType) {
+		return ctx.Respond([]interface{}{version})
+	}
+	return ctx.Respond(map[string]interface{}{"version": version})
+}
+
+func runVersionBuiltin(ctx *BuiltinContext) error {
+	if v, ok := ctx.With["version"]; ok {
+		return respondVersion(ctx, v)
+	}
+	var version Version
+	if err := json.Unmarshal([]byte(ctx.Param("VERSION_JSON")), &version); err != nil || len(version) == 0 {
+		return fmt.Errorf("no version in `with.version` or in the request")
+	}
+	return respondVersion(ctx, version)
+}
+
+func runTimestampBuiltin(ctx *BuiltinContext) error {
+	now := time.Now().UTC().Format(ctx.Arg("format", time.RFC3339))
+	return respondVersion(ctx, Version{ctx.Arg("key", "timestamp"): now})
+}
+
+func runWriteFileBuiltin(ctx *BuiltinContext) error {
+	dir := ctx.Param("DESTINATION_DIR")
+	if dir == "" {
+		dir = ctx.Param("SOURCES_DIR")
+	}
+	path := ctx.Arg("path", "")
+	if dir == "" || path == "" {
+		return fmt.Errorf("write_file requires `with.path` and a destination or sources directory")
+	}
+	path = filepath.Join(dir, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	fmt.Fprintf(ctx.Stderr, "writing %s\n", path)
+	return ioutil.WriteFile(path, []byte(ctx.Arg("content", "")), 0644)
+}
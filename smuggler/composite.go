@@ -0,0 +1,132 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Separator between the name of the sub-resource and the keys of its
+// version or metadata in the composite version
+const CompositeSeparator = "."
+
+func validateComposite(source SmugglerSource) error {
+	for name := range source.Composite {
+		if name == "" || strings.Contains(name, CompositeSeparator) {
+			return fmt.Errorf("invalid composite resource name '%s', must not be empty or contain '%s'", name, CompositeSeparator)
+		}
+	}
+	return nil
+}
+
+// Returns the version of a sub-resource from the composite version
+func subVersion(version Version, name string) Version {
+	prefix := name + CompositeSeparator
+	sub := make(Version)
+	for k, v := range version {
+		if strings.HasPrefix(k, prefix) {
+			sub[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+	return sub
+}
+
+// Runs the action in a sub-resource, whose source is any smuggler source
+func (command *SmugglerCommand) runSubResource(dataDir string, requestType RequestType, name string, source map[string]interface{}, version Version) (*ResourceResponse, error) {
+	command.logger.Printf("[INFO] Running %s action of composite resource '%s'", requestType, name)
+
+	jsonRequest, err := json.Marshal(RawResourceRequest{Source: source, Version: version})
+	if err != nil {
+		return nil, err
+	}
+	request, err := NewResourceRequest(requestType, string(jsonRequest))
+	if err != nil {
+		return nil, fmt.Errorf("composite resource '%s': %s", name, err)
+	}
+
+	subCommand := NewSmugglerCommand(command.logger)
+	response, err := subCommand.RunAction(dataDir, request)
+
+	// Report the output and status of the sub-resources as our own
+	if subCommand.lastCommand != nil {
+		command.lastCommand = subCommand.lastCommand
+	}
+	command.LastCommandOutput = append(command.LastCommandOutput, subCommand.LastCommandOutput...)
+	command.LastCommandErr = append(command.LastCommandErr, subCommand.LastCommandErr...)
+	command.LastCommandDuration += subCommand.LastCommandDuration
+	command.sensitiveValues = append(command.sensitiveValues, subCommand.sensitiveValues...)
+
+	if err != nil {
+		return nil, fmt.Errorf("composite resource '%s': %s", name, err)
+	}
+	return response, nil
+}
+
+// `check` returns one version with the latest version of each
+// sub-resource, or its current one if it returns none, with the keys
+// prefixed by its name. `in` gets each
+// sub-resource into a subdirectory with its name.
+func (command *SmugglerCommand) runComposite(dataDir string, request *ResourceRequest) (*ResourceResponse, error) {
+	response := ResourceResponse{Type: request.Type}
+	names := compositeNames(request.Source)
+
+	switch request.Type {
+	case CheckType:
+		combined := make(Version)
+		for _, name := range names {
+			r, err := command.runSubResource("", CheckType, name, request.Source.Composite[name], subVersion(request.Version, name))
+			if err != nil {
+				return &response, err
+			}
+			// Keep the current version of the sub-resources with nothing new,
+			// so that the composite version only changes with new versions
+			latest := subVersion(request.Version, name)
+			if len(r.Versions) > 0 {
+				latest = r.Versions[len(r.Versions)-1]
+			}
+			for k, v := range latest {
+				combined[name+CompositeSeparator+k] = v
+			}
+		}
+		if len(combined) > 0 {
+			response.Versions = []Version{combined}
+		}
+	case InType:
+		fetched := 0
+		for _, name := range names {
+			version := subVersion(request.Version, name)
+			if len(version) == 0 {
+				command.logger.Printf("[INFO] No version of composite resource '%s', skipping", name)
+				continue
+			}
+			subDir := filepath.Join(dataDir, name)
+			if err := os.MkdirAll(subDir, 0755); err != nil {
+				return &response, err
+			}
+			r, err := command.runSubResource(subDir, InType, name, request.Source.Composite[name], version)
+			if err != nil {
+				return &response, err
+			}
+			fetched++
+			for _, m := range r.Metadata {
+				response.Metadata = append(response.Metadata, MetadataPair{
+					Name:  name + CompositeSeparator + m.Name,
+					Value: m.Value,
+				})
+			}
+		}
+		if fetched == 0 {
+			return &response, fmt.Errorf(
+				"the version %s has no version of any composite resource, the keys must be prefixed by their names",
+				InterfaceToJsonString(request.Version),
+			)
+		}
+		response.Version = request.Version
+	default:
+		return &response, fmt.Errorf("%s is not supported by composite resources, define it in commands", request.Type)
+	}
+
+	return &response, command.finishResponse(request, &response)
+}
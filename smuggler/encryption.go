@@ -0,0 +1,200 @@
+package smuggler
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Prefix of the values encrypted with `smuggler encrypt`
+const EncryptedValuePrefix = "enc:v1:"
+
+// Prefix of the values sealed with the public key of the decryption key,
+// which can be encrypted without having the decryption key
+const SealedValuePrefix = EncryptedValuePrefix + "box:"
+
+// Environment variable with the path to the key to decrypt the values
+const DecryptionKeyFileEnv = "SMUGGLER_DECRYPTION_KEY_FILE"
+
+// Size of the AES-256 keys, and of the X25519 keys
+const EncryptionKeySize = 32
+
+func IsEncryptedValue(s string) bool {
+	return strings.HasPrefix(s, EncryptedValuePrefix)
+}
+
+// Generate a new random key, encoded in base64
+func GenerateEncryptionKey() (string, error) {
+	key := make([]byte, EncryptionKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Read a key file, which contains the key in base64 or the raw key bytes
+func ReadEncryptionKeyFile(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(content))); err == nil && len(key) == EncryptionKeySize {
+		return key, nil
+	}
+	if len(content) == EncryptionKeySize {
+		return content, nil
+	}
+	return nil, fmt.Errorf("the key in '%s' must be %d bytes, raw or encoded in base64", path, EncryptionKeySize)
+}
+
+// Read the key from the file in SMUGGLER_DECRYPTION_KEY_FILE
+func ReadDecryptionKey() ([]byte, error) {
+	path := os.Getenv(DecryptionKeyFileEnv)
+	if path == "" {
+		return nil, fmt.Errorf("found encrypted values but %s is not set", DecryptionKeyFileEnv)
+	}
+	return ReadEncryptionKeyFile(path)
+}
+
+// Encrypt the value with AES-GCM, returning `enc:v1:<base64 of nonce+ciphertext>`
+func EncryptValue(key []byte, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return EncryptedValuePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// The X25519 public key of a decryption key, to seal values with SealValue
+func PublicKey(key []byte) ([]byte, error) {
+	private, err := ecdh.X25519().NewPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return private.PublicKey().Bytes(), nil
+}
+
+// Encrypt the value for the holder of the decryption key of the public key,
+// with an ephemeral X25519 key and AES-GCM, returning
+// `enc:v1:box:<base64 of ephemeral public key+nonce+ciphertext>`
+func SealValue(publicKey []byte, plaintext string) (string, error) {
+	recipient, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid public key: %s", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return "", err
+	}
+	ephemeralPublic := ephemeral.PublicKey().Bytes()
+	gcm, err := newGCM(sealKey(shared, ephemeralPublic, publicKey))
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(append(ephemeralPublic, nonce...), nonce, []byte(plaintext), nil)
+	return SealedValuePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func openSealedValue(key []byte, value string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, SealedValuePrefix))
+	if err != nil {
+		return "", fmt.Errorf("decoding encrypted value: %s", err)
+	}
+	private, err := ecdh.X25519().NewPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < EncryptionKeySize {
+		return "", fmt.Errorf("the encrypted value is too short")
+	}
+	ephemeralPublic := sealed[:EncryptionKeySize]
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralPublic)
+	if err != nil {
+		return "", err
+	}
+	shared, err := private.ECDH(ephemeral)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(sealKey(shared, ephemeralPublic, private.PublicKey().Bytes()))
+	if err != nil {
+		return "", err
+	}
+	sealed = sealed[EncryptionKeySize:]
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("the encrypted value is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting value, is it encrypted with the right public key?: %s", err)
+	}
+	return string(plaintext), nil
+}
+
+// The AES key of a sealed value, from the X25519 shared secret and both
+// public keys
+func sealKey(shared []byte, ephemeralPublic []byte, recipientPublic []byte) []byte {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeralPublic)
+	h.Write(recipientPublic)
+	return h.Sum(nil)
+}
+
+// Decrypt a value produced by EncryptValue or SealValue
+func DecryptValue(key []byte, value string) (string, error) {
+	if strings.HasPrefix(value, SealedValuePrefix) {
+		return openSealedValue(key, value)
+	}
+	if !IsEncryptedValue(value) {
+		return "", fmt.Errorf("the value does not start with '%s'", EncryptedValuePrefix)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, EncryptedValuePrefix))
+	if err != nil {
+		return "", fmt.Errorf("decoding encrypted value: %s", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("the encrypted value is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting value, is it encrypted with the right key?: %s", err)
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,98 @@
+package smuggler
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Default prefix of the environment variables with the params
+const DefaultEnvPrefix = "SMUGGLER_"
+
+// Default replacement for the characters not valid in variable names
+const DefaultEnvReplacement = "_"
+
+var validEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var invalidEnvNameChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// How to name the environment variables passed to the commands
+type EnvNaming struct {
+	Prefix      string
+	Replacement string
+	Uppercase   bool
+}
+
+func (n EnvNaming) prefix() string {
+	if n.Prefix == "" {
+		return DefaultEnvPrefix
+	}
+	return n.Prefix
+}
+
+func (n EnvNaming) replacement() string {
+	if n.Replacement == "" {
+		return DefaultEnvReplacement
+	}
+	return n.Replacement
+}
+
+func (n EnvNaming) Validate() error {
+	if !validEnvName.MatchString(n.prefix()) {
+		return fmt.Errorf("invalid env_prefix '%s', must be a valid variable name", n.Prefix)
+	}
+	if invalidEnvNameChars.MatchString(n.replacement()) {
+		return fmt.Errorf("invalid env_replacement '%s', must contain only letters, digits or '_'", n.Replacement)
+	}
+	return nil
+}
+
+// Returns the name of the environment variable for a param.
+// Any character not valid in a variable name is replaced.
+func (n EnvNaming) VarName(key string) string {
+	name := invalidEnvNameChars.ReplaceAllLiteralString(key, n.replacement())
+	if n.Uppercase {
+		name = strings.ToUpper(name)
+	}
+	return n.prefix() + name
+}
+
+// Returns the names of the environment variables for the params,
+// failing if several params end up with the same name.
+func (n EnvNaming) VarNames(params map[string]interface{}) (map[string]string, error) {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	names := make(map[string]string, len(params))
+	origins := make(map[string]string, len(params))
+	for _, k := range keys {
+		name := n.VarName(k)
+		if other, ok := origins[name]; ok {
+			return nil, fmt.Errorf(
+				"params '%s' and '%s' are both passed as the environment variable '%s', rename one of them",
+				other, k, name,
+			)
+		}
+		origins[name] = k
+		names[k] = name
+	}
+	return names, nil
+}
+
+// Converts the params to a list of `<prefix><name>=<value>` variables
+func (n EnvNaming) Env(params map[string]interface{}) ([]string, error) {
+	names, err := n.VarNames(params)
+	if err != nil {
+		return nil, err
+	}
+	params_env := make([]string, 0, len(params))
+	for k, v := range params {
+		string_val := InterfaceToJsonString(v)
+		env_key_val := fmt.Sprintf("%s=%s", names[k], string_val)
+		params_env = append(params_env, env_key_val)
+	}
+	return params_env, nil
+}
@@ -0,0 +1,232 @@
+package smuggler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Origins of the params passed to the commands, from the lowest to the
+// highest precedence
+const (
+	OriginSourceSmugglerParams = "source.smuggler_params"
+	OriginConfigSmugglerParams = "smuggler.yml smuggler_params"
+	OriginSource               = "source"
+	OriginConfig               = "smuggler.yml"
+	OriginParamsSmugglerParams = "params.smuggler_params"
+	OriginParams               = "params"
+	OriginSmuggler             = "smuggler"
+)
+
+// What smuggler would run for a request, without running it. Filled by
+// RunAction in a dry run, see `smuggler_dry_run` and `smuggler explain`.
+type Explanation struct {
+	Action     RequestType
+	ConfigFile string
+	Command    *CommandDefinition
+	Wrapped    bool
+	Composite  []string
+	Params     []ExplainedParam
+	Stdin      []byte
+	// The `smuggler_params_file`, which is not read
+	ParamsFile string
+	// Why nothing would run, if so
+	Note string
+}
+
+// A param as the command gets it, with the variable and where it comes from
+type ExplainedParam struct {
+	Name   string
+	Var    string
+	Value  interface{}
+	Origin string
+}
+
+func (command *SmugglerCommand) isDryRun(request *ResourceRequest) bool {
+	return command.DryRun || request.Source.SmugglerDryRun || request.Params.SmugglerDryRun
+}
+
+// Completes the explanation with the command, its params and its stdin
+func (e *Explanation) explain(commandDefinition *CommandDefinition, wrapped bool, params map[string]interface{}, stdin []byte, builtins map[string]interface{}, request *ResourceRequest) error {
+	e.Command = commandDefinition
+	e.Wrapped = wrapped
+	e.Stdin = stdin
+
+	names, err := request.Source.EnvNaming().VarNames(params)
+	if err != nil {
+		return err
+	}
+	e.Params = make([]ExplainedParam, 0, len(params))
+	for _, name := range sortedKeys(params) {
+		e.Params = append(e.Params, ExplainedParam{
+			Name:   name,
+			Var:    names[name],
+			Value:  params[name],
+			Origin: paramOrigin(name, request, builtins),
+		})
+	}
+	return nil
+}
+
+// Where the param comes from, following the precedence of prepareParams
+func paramOrigin(name string, request *ResourceRequest, builtins map[string]interface{}) string {
+	if _, ok := builtins[name]; ok || name == "PARAM_NAMES" {
+		return OriginSmuggler
+	}
+	if _, ok := paramRoot(request.Params.ExtraParams, name, request.Source); ok {
+		return OriginParams
+	}
+	if _, ok := paramRoot(request.Params.SmugglerParams, name, request.Source); ok {
+		return OriginParamsSmugglerParams
+	}
+	if root, ok := paramRoot(request.Source.ExtraParams, name, request.Source); ok {
+		if request.ConfigKeys[root] {
+			return OriginConfig
+		}
+		return OriginSource
+	}
+	if root, ok := paramRoot(request.Source.SmugglerParams, name, request.Source); ok {
+		if request.ConfigKeys["smuggler_params."+root] {
+			return OriginConfigSmugglerParams
+		}
+		return OriginSourceSmugglerParams
+	}
+	return OriginSmuggler
+}
+
+// The key of the map the param comes from, which is a prefix of the name
+// for flattened params
+func paramRoot(m map[string]interface{}, name string, source SmugglerSource) (string, bool) {
+	if _, ok := m[name]; ok {
+		return name, true
+	}
+	if !source.FlattenParams {
+		return "", false
+	}
+	separator := source.FlattenSeparator
+	if separator == "" {
+		separator = DefaultFlattenSeparator
+	}
+	for k := range m {
+		if strings.HasPrefix(name, k+separator) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// The response of a dry run: the given version for check and in, and a
+// synthetic one for out
+func dryRunResponse(request *ResourceRequest) *ResourceResponse {
+	response := ResourceResponse{Type: request.Type}
+	switch request.Type {
+	case CheckType:
+		if len(request.Version) > 0 {
+			response.Versions = []Version{request.Version}
+		}
+	case InType:
+		response.Version = request.Version
+	case OutType:
+		response.Version = Version{"dry_run": time.Now().UTC().Format(time.RFC3339)}
+	}
+	if request.Type != CheckType {
+		response.Metadata = []MetadataPair{{Name: "dry_run", Value: "true"}}
+	}
+	return &response
+}
+
+func (e *Explanation) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Dry run of '%s', nothing was executed\n", e.Action)
+	if e.ConfigFile != "" {
+		fmt.Fprintf(&b, "Config: %s\n", e.ConfigFile)
+	} else {
+		fmt.Fprintf(&b, "Config: none\n")
+	}
+	if e.Note != "" {
+		fmt.Fprintf(&b, "%s\n", e.Note)
+	}
+	if len(e.Composite) > 0 {
+		fmt.Fprintf(&b, "Composite of: %s\n", strings.Join(e.Composite, ", "))
+	}
+	if e.Command == nil {
+		return b.String()
+	}
+
+	c := e.Command
+	switch {
+	case c.Builtin != "":
+		fmt.Fprintf(&b, "Command: builtin '%s' with %s\n", c.Builtin, InterfaceToJsonString(c.With))
+	case c.Starlark != "":
+		fmt.Fprintf(&b, "Command: starlark script\n%s", indent(c.Starlark))
+	default:
+		args := c.Args
+		if c.script != "" {
+			args = append(append(append([]string{}, c.scriptArgs...), "<script>"), c.Args...)
+		}
+		fmt.Fprintf(&b, "Command: %s", c.Path)
+		for _, arg := range args {
+			fmt.Fprintf(&b, " '%s'", arg)
+		}
+		fmt.Fprintf(&b, "\n")
+		if c.Plugin != "" {
+			fmt.Fprintf(&b, "Plugin: %s\n", c.Plugin)
+		}
+		if e.Wrapped {
+			fmt.Fprintf(&b, "Wrapped resource: yes\n")
+		}
+		if c.script != "" {
+			fmt.Fprintf(&b, "Script:\n%s", indent(c.script))
+		}
+	}
+
+	// It is printed to the build log, so only the values set by smuggler
+	// are shown, the ones of the user can be secrets
+	fmt.Fprintf(&b, "Params:\n")
+	for _, p := range e.Params {
+		value := redactedValue
+		if p.Origin == OriginSmuggler {
+			value = InterfaceToJsonString(p.Value)
+		}
+		fmt.Fprintf(&b, "  %s=%s (%s, from %s)\n", p.Var, value, p.Name, p.Origin)
+	}
+	if e.ParamsFile != "" {
+		fmt.Fprintf(&b, "  and the params in smuggler_params_file '%s', not read in a dry run\n", e.ParamsFile)
+	}
+	fmt.Fprintf(&b, "Stdin:\n%s", indent(redactStdin(e.Stdin)))
+	return b.String()
+}
+
+// The JSON request with the values of the params redacted. Other formats
+// are not printed, as they contain the values.
+func redactStdin(stdin []byte) string {
+	if len(bytes.TrimSpace(stdin)) == 0 {
+		return ""
+	}
+	var request map[string]interface{}
+	if json.Unmarshal(stdin, &request) != nil {
+		return fmt.Sprintf("(%d bytes, not printed as they contain the params)", len(stdin))
+	}
+	return string(redactRequest(stdin))
+}
+
+func indent(s string) string {
+	if s == "" {
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	return "  " + strings.Join(lines, "\n  ") + "\n"
+}
+
+// Names of the sub-resources of a composite resource, sorted
+func compositeNames(source SmugglerSource) []string {
+	names := make([]string, 0, len(source.Composite))
+	for name := range source.Composite {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,417 @@
+package smuggler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Kinds of problems found by LintPipeline
+const (
+	// A variable not set for the action, with no default in the script
+	LintUndefined = "undefined"
+	// A variable set by smuggler only for other actions
+	LintInvalidForAction = "invalid-for-action"
+	// A configuration smuggler cannot parse, so the commands are not linted
+	LintInvalidConfig = "invalid-config"
+	// A param not referenced by any command. Only a warning, as the
+	// commands can read it from stdin or the params files.
+	LintUnused = "unused"
+)
+
+// Variables which give access to all the params, so that any of them
+// could be used without being referenced
+var bulkParamVars = []string{
+	"PARAMS_DIR", "PARAMS_FILE", "PARAM_NAMES", "REQUEST_FILE", "FILTERED_REQUEST_FILE",
+}
+
+// A problem with the variables of a command of a resource of the pipeline,
+// in a `get` or `put` step of a job for `in` and `out`
+type LintIssue struct {
+	Resource string
+	Action   RequestType
+	Job      string
+	Step     string
+	Kind     string
+	Variable string
+	Param    string
+	Message  string
+}
+
+func (issue LintIssue) IsError() bool {
+	return issue.Kind != LintUnused
+}
+
+func (issue LintIssue) String() string {
+	level := "error"
+	if !issue.IsError() {
+		level = "warning"
+	}
+	where := issue.Resource
+	if issue.Action != "" {
+		where += " " + string(issue.Action)
+	}
+	if issue.Job != "" {
+		where += fmt.Sprintf(" (job %s, step %s)", issue.Job, issue.Step)
+	}
+	return fmt.Sprintf("%s: %s: %s", level, where, issue.Message)
+}
+
+// Lints the shell commands of the resources of the pipeline, and the
+// script files they run, looking for references to variables with params
+// which are not set for the action, or params which are never used.
+//
+// The resources are the ones of resourceType, or the ones with `commands`
+// in the source if empty. The config is merged into their source as
+// `smuggler.yml`, and relative script paths are looked up in scriptsDir.
+func LintPipeline(pipeline *Pipeline, config []byte, resourceType string, scriptsDir string) ([]LintIssue, error) {
+	var issues []LintIssue
+	for _, resource := range pipeline.Resources {
+		if resourceType != "" && resource.Type != resourceType {
+			continue
+		}
+		if _, ok := resource.Source["commands"]; resourceType == "" && !ok {
+			continue
+		}
+		linter := resourceLinter{
+			pipeline:   pipeline,
+			resource:   resource,
+			config:     config,
+			scriptsDir: scriptsDir,
+		}
+		resourceIssues, err := linter.lint()
+		if err != nil {
+			resourceIssues = []LintIssue{{
+				Resource: resource.Name,
+				Kind:     LintInvalidConfig,
+				Message:  err.Error(),
+			}}
+		}
+		issues = append(issues, resourceIssues...)
+	}
+	return issues, nil
+}
+
+type resourceLinter struct {
+	pipeline   *Pipeline
+	resource   PipelineResource
+	config     []byte
+	scriptsDir string
+}
+
+// The variables referenced by a command
+type varReferences struct {
+	// Whether the action has a command
+	defined bool
+	// Whether the text of the command could be read
+	scanned bool
+	// Variable names without the prefix, and whether all the references
+	// to each one have a default value, as in `${SMUGGLER_name:-default}`
+	vars map[string]bool
+}
+
+func (refs varReferences) uses(name string) bool {
+	_, ok := refs.vars[name]
+	return ok
+}
+
+func (refs varReferences) usesAnyParam() bool {
+	for _, name := range bulkParamVars {
+		if refs.uses(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *resourceLinter) lint() ([]LintIssue, error) {
+	var issues []LintIssue
+
+	// The source params must be used by some action
+	sourceRequest, err := l.request(CheckType, nil)
+	if err != nil {
+		return nil, err
+	}
+	naming := sourceRequest.Source.EnvNaming()
+	allRefs := varReferences{scanned: true, vars: make(map[string]bool)}
+
+	for _, requestType := range []RequestType{CheckType, InType, OutType} {
+		refs, err := l.references(sourceRequest, requestType)
+		if err != nil {
+			return nil, err
+		}
+		if !refs.scanned {
+			allRefs.scanned = false
+			continue
+		}
+		for name := range refs.vars {
+			allRefs.vars[name] = true
+		}
+		if !refs.defined {
+			continue
+		}
+		allRefs.defined = true
+
+		for _, step := range l.steps(requestType) {
+			request, err := l.request(requestType, step.task.Params)
+			if err != nil {
+				return nil, err
+			}
+			stepIssues, err := l.lintStep(request, refs, naming)
+			if err != nil {
+				return nil, err
+			}
+			for i := range stepIssues {
+				stepIssues[i].Job = step.job
+				stepIssues[i].Step = step.name()
+			}
+			issues = append(issues, stepIssues...)
+		}
+	}
+
+	if allRefs.defined && allRefs.scanned && !allRefs.usesAnyParam() {
+		params := copyMaps(sourceRequest.Source.SmugglerParams, sourceRequest.Source.ExtraParams)
+		for _, name := range sortedKeys(params) {
+			if !paramUsed(name, allRefs, naming, sourceRequest.Source) {
+				issues = append(issues, LintIssue{
+					Resource: l.resource.Name,
+					Kind:     LintUnused,
+					Variable: naming.VarName(name),
+					Param:    name,
+					Message:  fmt.Sprintf("param '%s' of the source is not used by any command", name),
+				})
+			}
+		}
+	}
+	return issues, nil
+}
+
+type lintStep struct {
+	job  string
+	task Task
+}
+
+// The name of the step in the plan, which is the resource if not aliased
+func (step lintStep) name() string {
+	if step.task.GetName != "" {
+		return step.task.GetName
+	}
+	return step.task.PutName
+}
+
+// The steps running the action: `check` once with no params, and `in` and
+// `out` in each `get` or `put` step of the resource
+func (l *resourceLinter) steps(requestType RequestType) []lintStep {
+	if requestType == CheckType {
+		return []lintStep{{}}
+	}
+	var steps []lintStep
+	for _, job := range l.pipeline.Jobs {
+		for _, task := range job.Plan {
+			if task.ResourceName() != l.resource.Name {
+				continue
+			}
+			if (requestType == InType && task.GetName != "") || (requestType == OutType && task.PutName != "") {
+				steps = append(steps, lintStep{job: job.Name, task: task})
+			}
+		}
+	}
+	return steps
+}
+
+// The request of the action as concourse would send it, merged with the
+// config
+func (l *resourceLinter) request(requestType RequestType, params map[string]interface{}) (*ResourceRequest, error) {
+	input, err := json.Marshal(RawResourceRequest{Source: l.resource.Source, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	if len(l.config) > 0 {
+		return ParseInputAndConfig(requestType, input, l.config), nil
+	}
+	return NewResourceRequest(requestType, string(input))
+}
+
+func (l *resourceLinter) lintStep(request *ResourceRequest, refs varReferences, naming EnvNaming) ([]LintIssue, error) {
+	var issues []LintIssue
+	issue := func(kind string, variable string, param string, format string, args ...interface{}) {
+		issues = append(issues, LintIssue{
+			Resource: l.resource.Name,
+			Action:   request.Type,
+			Kind:     kind,
+			Variable: variable,
+			Param:    param,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	params := copyMaps(
+		request.Source.SmugglerParams,
+		request.Source.ExtraParams,
+		request.Params.SmugglerParams,
+		request.Params.ExtraParams,
+	)
+	var err error
+	if request.Source.FlattenParams {
+		params, err = flattenParams(params, request.Source.FlattenSeparator)
+		if err != nil {
+			return nil, err
+		}
+	}
+	params = selectEnvParams(params, request.Source.ParamsAsEnv)
+	defined := make(map[string]bool)
+	for k := range params {
+		defined[naming.VarName(k)] = true
+	}
+	for k := range builtinParams("", "", request) {
+		defined[naming.VarName(k)] = true
+	}
+	defined[naming.VarName("PARAM_NAMES")] = true
+
+	prefix := naming.prefix()
+	names := make([]string, 0, len(refs.vars))
+	for name := range refs.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		variable := prefix + name
+		if defined[variable] {
+			continue
+		}
+		if strings.HasPrefix(name, "VERSION_") && request.Type != OutType {
+			// The keys of the version are not known
+			continue
+		}
+		if refs.vars[name] {
+			// Fine without the variable, e.g. scripts shared by actions
+			continue
+		}
+		if actions := builtinActions(name, request.Source); len(actions) > 0 {
+			issue(LintInvalidForAction, variable, name, "%s is not set in '%s', only in '%s'",
+				variable, request.Type, strings.Join(actions, "', '"))
+			continue
+		}
+		// The params in the file are not known
+		if request.Params.SmugglerParamsFile != "" {
+			continue
+		}
+		issue(LintUndefined, variable, name, "%s is not defined", variable)
+	}
+
+	if !refs.usesAnyParam() {
+		stepParams := copyMaps(request.Params.SmugglerParams, request.Params.ExtraParams)
+		for _, name := range sortedKeys(stepParams) {
+			if !paramUsed(name, refs, naming, request.Source) {
+				issue(LintUnused, naming.VarName(name), name,
+					"param '%s' is not used by the '%s' command", name, request.Type)
+			}
+		}
+	}
+	return issues, nil
+}
+
+// The actions for which smuggler sets the variable
+func builtinActions(name string, source SmugglerSource) []string {
+	var actions []string
+	for _, requestType := range []RequestType{CheckType, InType, OutType} {
+		request := ResourceRequest{Type: requestType, Source: source}
+		if _, ok := builtinParams("", "", &request)[name]; ok ||
+			(strings.HasPrefix(name, "VERSION_") && requestType != OutType) {
+			actions = append(actions, string(requestType))
+		}
+	}
+	return actions
+}
+
+// Whether the param, or any of its flattened params, is referenced
+func paramUsed(name string, refs varReferences, naming EnvNaming, source SmugglerSource) bool {
+	prefix := naming.prefix()
+	variable := strings.TrimPrefix(naming.VarName(name), prefix)
+	if refs.uses(variable) {
+		return true
+	}
+	if !source.FlattenParams {
+		return false
+	}
+	separator := source.FlattenSeparator
+	if separator == "" {
+		separator = DefaultFlattenSeparator
+	}
+	flattenedPrefix := strings.TrimPrefix(naming.VarName(name+separator), prefix)
+	for ref := range refs.vars {
+		if strings.HasPrefix(ref, flattenedPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// The variables referenced by the shell command of the action and by the
+// script files in its path or arguments. Other commands are not scanned.
+func (l *resourceLinter) references(request *ResourceRequest, requestType RequestType) (varReferences, error) {
+	refs := varReferences{vars: make(map[string]bool)}
+	commandDefinition, err := request.Source.FindCommand(string(requestType))
+	if err != nil {
+		return refs, err
+	}
+	if commandDefinition == nil {
+		// Wrapped and composite resources pass the params to other ones
+		refs.scanned = request.Source.Wrap == nil && request.Source.Composite == nil
+		return refs, nil
+	}
+	refs.defined = true
+	if commandDefinition.Builtin != "" || commandDefinition.Starlark != "" || commandDefinition.Plugin != "" {
+		return refs, nil
+	}
+
+	texts := []string{commandDefinition.Script, commandDefinition.script}
+	for _, arg := range append([]string{commandDefinition.Path}, commandDefinition.Args...) {
+		texts = append(texts, arg)
+		if content, ok := l.readScript(arg); ok {
+			texts = append(texts, content)
+		}
+	}
+
+	naming := request.Source.EnvNaming()
+	varRegexp := regexp.MustCompile(
+		`(\$\{#?)?\b` + regexp.QuoteMeta(naming.prefix()) + `([A-Za-z0-9_]+)(:?[-=+])?`,
+	)
+	for _, text := range texts {
+		for _, match := range varRegexp.FindAllStringSubmatch(text, -1) {
+			name := match[2]
+			hasDefault := match[1] != "" && match[3] != ""
+			if withDefault, ok := refs.vars[name]; ok {
+				hasDefault = hasDefault && withDefault
+			}
+			refs.vars[name] = hasDefault
+		}
+	}
+	refs.scanned = true
+	return refs, nil
+}
+
+// Reads the script file in the path, if it is a text file
+func (l *resourceLinter) readScript(path string) (string, bool) {
+	if path == "" || strings.ContainsAny(path, "\n") {
+		return "", false
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(l.scriptsDir, path)
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > 1024*1024 {
+		return "", false
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil || bytes.IndexByte(content, 0) >= 0 {
+		return "", false
+	}
+	return string(content), true
+}
@@ -0,0 +1,92 @@
+package smuggler_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+var _ = Describe("LintPipeline", func() {
+	var issues []LintIssue
+
+	BeforeEach(func() {
+		lintPipeline, err := LoadPipeline("../fixtures/lint/pipeline.yml")
+		Ω(err).ShouldNot(HaveOccurred())
+		issues, err = LintPipeline(lintPipeline, nil, "", "../fixtures/lint")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("reports the variables not defined in the step", func() {
+		Ω(issues).Should(ContainElement(LintIssue{
+			Resource: "files", Action: InType, Job: "build", Step: "other_files",
+			Kind: LintUndefined, Variable: "SMUGGLER_name", Param: "name",
+			Message: "SMUGGLER_name is not defined",
+		}))
+		for _, issue := range issues {
+			if issue.Step == "files" {
+				Ω(issue.Variable).ShouldNot(Equal("SMUGGLER_name"))
+			}
+		}
+	})
+
+	It("reports the variables of the script files", func() {
+		Ω(issues).Should(ContainElement(LintIssue{
+			Resource: "files", Action: OutType, Job: "build", Step: "files",
+			Kind: LintUndefined, Variable: "SMUGGLER_traget_file", Param: "traget_file",
+			Message: "SMUGGLER_traget_file is not defined",
+		}))
+	})
+
+	It("reports the variables set by smuggler only in other actions", func() {
+		Ω(issues).Should(ContainElement(LintIssue{
+			Resource: "files", Action: InType, Job: "build", Step: "files",
+			Kind: LintInvalidForAction, Variable: "SMUGGLER_SOURCES_DIR", Param: "SOURCES_DIR",
+			Message: "SMUGGLER_SOURCES_DIR is not set in 'in', only in 'out'",
+		}))
+	})
+
+	It("accepts variables with a default value", func() {
+		for _, issue := range issues {
+			Ω(issue.Variable).ShouldNot(Equal("SMUGGLER_DESTINATION_DIR"))
+		}
+	})
+
+	It("reports the unused params of the source and the steps as warnings", func() {
+		Ω(issues).Should(ContainElement(LintIssue{
+			Resource: "files", Kind: LintUnused, Variable: "SMUGGLER_unused_source_param", Param: "unused_source_param",
+			Message: "param 'unused_source_param' of the source is not used by any command",
+		}))
+		Ω(issues).Should(ContainElement(LintIssue{
+			Resource: "files", Action: InType, Job: "build", Step: "other_files",
+			Kind: LintUnused, Variable: "SMUGGLER_unused_step_param", Param: "unused_step_param",
+			Message: "param 'unused_step_param' is not used by the 'in' command",
+		}))
+		Ω(LintIssue{Kind: LintUnused}.IsError()).Should(BeFalse())
+		Ω(LintIssue{Kind: LintUndefined}.IsError()).Should(BeTrue())
+	})
+
+	It("does not report unused params when the command reads all of them", func() {
+		for _, issue := range issues {
+			Ω(issue.Resource).ShouldNot(Equal("all_params"))
+		}
+	})
+
+	It("reports the resources which cannot be parsed", func() {
+		Ω(issues).Should(ContainElement(LintIssue{
+			Resource: "broken", Kind: LintInvalidConfig,
+			Message: "unknown builtin 'unknown' in 'check', must be one of: noop, timestamp, version, write_file",
+		}))
+	})
+
+	It("only lints the resources with commands", func() {
+		for _, issue := range issues {
+			Ω(issue.Resource).ShouldNot(Equal("not_smuggler"))
+		}
+	})
+
+	It("prints the issues with the resource, action and step", func() {
+		Ω(issues[0].String()).Should(Equal(
+			"error: files in (job build, step files): SMUGGLER_SOURCES_DIR is not set in 'in', only in 'out'"))
+	})
+})
@@ -0,0 +1,118 @@
+package smuggler
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Version of smuggler, overridden at build time with
+// -ldflags "-X github.com/redfactorlabs/concourse-smuggler-resource/smuggler.SmugglerVersion=..."
+var SmugglerVersion = "dev"
+
+// Policies to apply when the command already reported a metadata entry
+// with the same name as one of the automatic metadata
+const (
+	AutoMetadataKeep    = "keep"
+	AutoMetadataReplace = "replace"
+	AutoMetadataAppend  = "append"
+)
+
+type autoMetadataFunc func(command *SmugglerCommand) (string, bool)
+
+var autoMetadataProviders = map[string]autoMetadataFunc{
+	"duration": func(command *SmugglerCommand) (string, bool) {
+		return command.LastCommandDuration.String(), true
+	},
+	"smuggler_version": func(command *SmugglerCommand) (string, bool) {
+		return SmugglerVersion, true
+	},
+	"hostname": func(command *SmugglerCommand) (string, bool) {
+		h, err := os.Hostname()
+		if err != nil {
+			return "", false
+		}
+		return h, true
+	},
+	"build_url": func(command *SmugglerCommand) (string, bool) {
+		u := BuildUrlFromEnv()
+		return u, u != ""
+	},
+}
+
+// Compose the URL of the current build from the environment variables
+// that concourse sets for in/out.
+// See https://concourse.ci/implementing-resources.html#resource-metadata
+func BuildUrlFromEnv() string {
+	atcUrl := strings.TrimRight(os.Getenv("ATC_EXTERNAL_URL"), "/")
+	if atcUrl == "" {
+		return ""
+	}
+	team := os.Getenv("BUILD_TEAM_NAME")
+	pipeline := os.Getenv("BUILD_PIPELINE_NAME")
+	job := os.Getenv("BUILD_JOB_NAME")
+	build := os.Getenv("BUILD_NAME")
+	if team != "" && pipeline != "" && job != "" && build != "" {
+		return fmt.Sprintf("%s/teams/%s/pipelines/%s/jobs/%s/builds/%s", atcUrl, team, pipeline, job, build)
+	}
+	if id := os.Getenv("BUILD_ID"); id != "" {
+		return fmt.Sprintf("%s/builds/%s", atcUrl, id)
+	}
+	return ""
+}
+
+// Metadata that would always have the same value, as it is only reported
+// when the command succeeds and smuggler does not retry the commands
+var unsupportedAutoMetadata = map[string]string{
+	"exit_code": "it would always be 0, the metadata is only reported when the command succeeds",
+	"attempts":  "it would always be 1, smuggler does not retry the commands",
+}
+
+func validateAutoMetadata(source SmugglerSource) error {
+	for _, name := range source.AutoMetadata {
+		if reason, ok := unsupportedAutoMetadata[name]; ok {
+			return fmt.Errorf("auto_metadata '%s' is not supported: %s", name, reason)
+		}
+		if _, ok := autoMetadataProviders[name]; !ok {
+			return fmt.Errorf("unknown auto_metadata '%s'", name)
+		}
+	}
+	switch source.AutoMetadataOnConflict {
+	case "", AutoMetadataKeep, AutoMetadataReplace, AutoMetadataAppend:
+	default:
+		return fmt.Errorf(
+			"invalid auto_metadata_on_conflict '%s', must be one of: %s, %s, %s",
+			source.AutoMetadataOnConflict, AutoMetadataKeep, AutoMetadataReplace, AutoMetadataAppend,
+		)
+	}
+	return nil
+}
+
+// Add the metadata requested in `auto_metadata` to the response.
+// By default, the metadata reported by the command has priority.
+func appendAutoMetadata(command *SmugglerCommand, source SmugglerSource, response *ResourceResponse) {
+	for _, name := range source.AutoMetadata {
+		value, ok := autoMetadataProviders[name](command)
+		if !ok {
+			continue
+		}
+		pair := MetadataPair{Name: name, Value: value}
+
+		existing := -1
+		for i, m := range response.Metadata {
+			if m.Name == name {
+				existing = i
+				break
+			}
+		}
+
+		switch {
+		case existing < 0, source.AutoMetadataOnConflict == AutoMetadataAppend:
+			response.Metadata = append(response.Metadata, pair)
+		case source.AutoMetadataOnConflict == AutoMetadataReplace:
+			response.Metadata[existing] = pair
+		default:
+			command.logger.Printf("[INFO] command already reported metadata '%s', not overriding it", name)
+		}
+	}
+}
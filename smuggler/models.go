@@ -2,6 +2,9 @@ package smuggler
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
 	"strings"
 
@@ -9,37 +12,160 @@ import (
 )
 
 type SmugglerSource struct {
-	Commands         map[string]interface{} `json:"commands,omitempty"`
-	FilterRawRequest bool                   `json:"filter_raw_request,omitempty"`
-	SmugglerDebug    bool                   `json:"smuggler_debug,omitempty"`
-	SmugglerParams   map[string]interface{} `json:"smuggler_params,omitempty"`
-	ExtraParams      map[string]interface{} `json:"-"`
+	Commands               map[string]interface{}            `json:"commands,omitempty"`
+	FilterRawRequest       bool                              `json:"filter_raw_request,omitempty"`
+	SmugglerDebug          bool                              `json:"smuggler_debug,omitempty"`
+	SmugglerDryRun         bool                              `json:"smuggler_dry_run,omitempty"`
+	SmugglerParams         map[string]interface{}            `json:"smuggler_params,omitempty"`
+	AutoMetadata           []string                          `json:"auto_metadata,omitempty"`
+	AutoMetadataOnConflict string                            `json:"auto_metadata_on_conflict,omitempty"`
+	ResponseMode           string                            `json:"response_mode,omitempty"`
+	ResponseFd             bool                              `json:"response_fd,omitempty"`
+	RequestFormat          string                            `json:"request_format,omitempty"`
+	FlattenParams          bool                              `json:"flatten_params,omitempty"`
+	FlattenSeparator       string                            `json:"flatten_separator,omitempty"`
+	EnvPrefix              string                            `json:"env_prefix,omitempty"`
+	EnvReplacement         string                            `json:"env_replacement,omitempty"`
+	EnvUppercase           bool                              `json:"env_uppercase,omitempty"`
+	ParamsAsEnv            *ParamsAsEnv                      `json:"params_as_env,omitempty"`
+	Resolvers              map[string]interface{}            `json:"resolvers,omitempty"`
+	Wrap                   *WrapConfig                       `json:"wrap,omitempty"`
+	Composite              map[string]map[string]interface{} `json:"composite,omitempty"`
+	Shell                  *ShellConfig                      `json:"shell,omitempty"`
+	ExtraParams            map[string]interface{}            `json:"-"`
 }
 
-func WrapCommandWithShell(name string, commandLine string) *CommandDefinition {
-	// Try to find bash
-	shellPath, err := exec.LookPath("bash")
-	if err == nil {
-		return &CommandDefinition{
-			Path: shellPath,
-			Args: []string{"-e", "-u", "-o", "pipefail", "-c", commandLine},
+// Ways to read the response of a command
+const (
+	ResponseModeAuto   = "auto"
+	ResponseModeStdout = "stdout"
+	ResponseModeFiles  = "files"
+	ResponseModeMerged = "merged"
+)
+
+// Encodings of the request sent to the command via stdin
+const (
+	RequestFormatJson    = "json"
+	RequestFormatYaml    = "yaml"
+	RequestFormatEnvFile = "env-file"
+	RequestFormatNone    = "none"
+)
+
+// Check that the smuggler specific configuration is valid
+func (source SmugglerSource) Validate() error {
+	switch source.ResponseMode {
+	case "", ResponseModeAuto, ResponseModeStdout, ResponseModeFiles, ResponseModeMerged:
+	default:
+		return fmt.Errorf(
+			"invalid response_mode '%s', must be one of: %s, %s, %s, %s",
+			source.ResponseMode, ResponseModeAuto, ResponseModeStdout, ResponseModeFiles, ResponseModeMerged,
+		)
+	}
+	switch source.RequestFormat {
+	case "", RequestFormatJson, RequestFormatYaml, RequestFormatEnvFile, RequestFormatNone:
+	default:
+		return fmt.Errorf(
+			"invalid request_format '%s', must be one of: %s, %s, %s, %s",
+			source.RequestFormat, RequestFormatJson, RequestFormatYaml, RequestFormatEnvFile, RequestFormatNone,
+		)
+	}
+	if err := source.EnvNaming().Validate(); err != nil {
+		return err
+	}
+	if source.Shell != nil {
+		if err := source.Shell.Validate(); err != nil {
+			return err
 		}
 	}
-	// Try to find sh
-	shellPath, err = exec.LookPath("sh")
-	if err == nil {
+	if source.Wrap != nil {
+		if err := source.Wrap.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateComposite(source); err != nil {
+		return err
+	}
+	return validateAutoMetadata(source)
+}
+
+func (source SmugglerSource) EnvNaming() EnvNaming {
+	return EnvNaming{
+		Prefix:      source.EnvPrefix,
+		Replacement: source.EnvReplacement,
+		Uppercase:   source.EnvUppercase,
+	}
+}
+
+// Shell used to run the command lines, with the flags passed before the
+// script
+type ShellConfig struct {
+	Path  string   `json:"path,omitempty"`
+	Flags []string `json:"flags,omitempty"`
+}
+
+func (shell ShellConfig) Validate() error {
+	if shell.Path == "" {
+		return fmt.Errorf("shell.path is required")
+	}
+	return nil
+}
+
+// Shells tried when none is configured
+var defaultShells = []ShellConfig{
+	{Path: "bash", Flags: []string{"-e", "-u", "-o", "pipefail", "-c"}},
+	{Path: "sh", Flags: []string{"-e", "-u", "-c"}},
+}
+
+// Returns the command to run a command line: with the interpreter of its
+// shebang (`#!`) line, or with the given shell, or with bash or sh.
+func WrapCommandWithShell(name string, commandLine string, shell *ShellConfig) (*CommandDefinition, error) {
+	if strings.HasPrefix(commandLine, "#!") {
+		return shebangCommand(name, commandLine)
+	}
+	if shell != nil {
+		shellPath, err := exec.LookPath(shell.Path)
+		if err != nil {
+			return nil, fmt.Errorf("shell '%s' for '%s' not found: %s", shell.Path, name, err)
+		}
+		flags := shell.Flags
+		if flags == nil {
+			flags = []string{"-c"}
+		}
 		return &CommandDefinition{
 			Path: shellPath,
-			Args: []string{"-e", "-u", "-o", "pipefail", "-c", commandLine},
+			Args: append(append([]string{}, flags...), commandLine),
+		}, nil
+	}
+	for _, defaultShell := range defaultShells {
+		shellPath, err := exec.LookPath(defaultShell.Path)
+		if err == nil {
+			return &CommandDefinition{
+				Path: shellPath,
+				Args: append(append([]string{}, defaultShell.Flags...), commandLine),
+			}, nil
 		}
 	}
+	return nil, fmt.Errorf("no shell found to run '%s': install bash or sh, or configure one in `shell`", name)
+}
 
-	// In last case, use the command itself
-	l := strings.Split(commandLine, ",")
-	return &CommandDefinition{
-		Path: l[0],
-		Args: l[1:],
+// The script is written to a temporary file when the command runs, and
+// passed to the interpreter after the arguments of the shebang line and
+// before the ones of the command
+func shebangCommand(name string, commandLine string) (*CommandDefinition, error) {
+	shebang := strings.SplitN(commandLine, "\n", 2)[0]
+	fields := strings.Fields(strings.TrimPrefix(shebang, "#!"))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty interpreter in the shebang line of '%s'", name)
 	}
+	interpreter, err := exec.LookPath(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("interpreter '%s' for '%s' not found: %s", fields[0], name, err)
+	}
+	return &CommandDefinition{
+		Path:       interpreter,
+		script:     commandLine,
+		scriptArgs: fields[1:],
+	}, nil
 }
 
 func (source SmugglerSource) FindCommand(name string) (*CommandDefinition, error) {
@@ -47,18 +173,108 @@ func (source SmugglerSource) FindCommand(name string) (*CommandDefinition, error
 	if !ok {
 		return nil, nil
 	}
+	return parseCommand(name, cmd, source.Shell)
+}
+
+// A command is a shell command line or a {path, args} definition
+func parseCommand(name string, cmd interface{}, shell *ShellConfig) (*CommandDefinition, error) {
 	switch cmd := cmd.(type) {
 	case string:
-		return WrapCommandWithShell(name, cmd), nil
+		return WrapCommandWithShell(name, cmd, shell)
 	default:
 		c, err := NewCommandDefinition(cmd)
-		return c, err
+		if err != nil {
+			return nil, err
+		}
+		if c.Script != "" {
+			if c.Path != "" {
+				return nil, fmt.Errorf("'%s' can not have both `path` and `script`", name)
+			}
+			if c.Shell != nil {
+				if err := c.Shell.Validate(); err != nil {
+					return nil, fmt.Errorf("invalid shell in '%s': %s", name, err)
+				}
+				shell = c.Shell
+			}
+			wrapped, err := WrapCommandWithShell(name, c.Script, shell)
+			if err != nil {
+				return nil, err
+			}
+			c.Path, c.Args = wrapped.Path, append(wrapped.Args, c.Args...)
+			c.script, c.scriptArgs = wrapped.script, wrapped.scriptArgs
+		}
+		if c.Builtin != "" {
+			if _, ok := FindBuiltin(c.Builtin); !ok {
+				return nil, fmt.Errorf("unknown builtin '%s' in '%s', must be one of: %s",
+					c.Builtin, name, strings.Join(BuiltinNames(), ", "))
+			}
+		}
+		if c.Starlark != "" {
+			if err := validateStarlark(name, c.Starlark); err != nil {
+				return nil, fmt.Errorf("invalid starlark script in '%s': %s", name, err)
+			}
+		}
+		if c.Plugin != "" {
+			if err := resolvePluginCommand(c); err != nil {
+				return nil, fmt.Errorf("invalid plugin command in '%s': %s", name, err)
+			}
+		}
+		return c, nil
+	}
+}
+
+// Which params are passed as environment variables: all of them (`true`),
+// none (`false`) or the given list of param names
+type ParamsAsEnv struct {
+	All   bool
+	Names []string
+}
+
+func (p *ParamsAsEnv) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &p.All); err == nil {
+		p.Names = nil
+		return nil
 	}
+	p.All = false
+	if err := json.Unmarshal(b, &p.Names); err != nil {
+		return fmt.Errorf("params_as_env must be a boolean or a list of param names: %s", err)
+	}
+	return nil
+}
+
+func (p ParamsAsEnv) MarshalJSON() ([]byte, error) {
+	if p.Names != nil {
+		return json.Marshal(p.Names)
+	}
+	return json.Marshal(p.All)
+}
+
+func (p ParamsAsEnv) Includes(name string) bool {
+	if p.All {
+		return true
+	}
+	for _, n := range p.Names {
+		if n == name {
+			return true
+		}
+	}
+	return false
 }
 
 type CommandDefinition struct {
-	Path string   `json:"path"`
-	Args []string `json:"args,omitempty"`
+	Path     string                 `json:"path,omitempty"`
+	Args     []string               `json:"args,omitempty"`
+	Script   string                 `json:"script,omitempty"`
+	Shell    *ShellConfig           `json:"shell,omitempty"`
+	Builtin  string                 `json:"builtin,omitempty"`
+	Plugin   string                 `json:"plugin,omitempty"`
+	Starlark string                 `json:"starlark,omitempty"`
+	With     map[string]interface{} `json:"with,omitempty"`
+
+	// Script of a shebang command and arguments of its interpreter,
+	// see WrapCommandWithShell
+	script     string
+	scriptArgs []string
 }
 
 func NewCommandDefinition(i interface{}) (*CommandDefinition, error) {
@@ -77,8 +293,33 @@ func NewCommandDefinition(i interface{}) (*CommandDefinition, error) {
 	return &c, nil
 }
 
+// Returns the arguments to run the command with the extra ones. Shebang
+// commands get their script in a temporary file, deleted with the
+// returned function.
+func (commandDefinition CommandDefinition) prepareArgs(extraArgs ...string) ([]string, func(), error) {
+	if commandDefinition.script == "" {
+		return append(append([]string{}, commandDefinition.Args...), extraArgs...), func() {}, nil
+	}
+	f, err := ioutil.TempFile("", "smuggler-script-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.Remove(f.Name()) }
+	_, err = f.WriteString(commandDefinition.script)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	args := append(append([]string{}, commandDefinition.scriptArgs...), f.Name())
+	args = append(append(args, commandDefinition.Args...), extraArgs...)
+	return args, cleanup, nil
+}
+
 func (commandDefinition CommandDefinition) IsDefined() bool {
-	return (commandDefinition.Path != "")
+	return (commandDefinition.Path != "" || commandDefinition.Builtin != "" || commandDefinition.Starlark != "")
 }
 
 type MetadataPair struct {
@@ -120,6 +361,11 @@ type ResourceRequest struct {
 	Params          TaskParams          `json:"params,omitempty"`
 	OrigRequest     *RawResourceRequest `json:"-"`
 	FilteredRequest *RawResourceRequest `json:"-"`
+
+	// The `smuggler.yml` merged into the source and the keys it set,
+	// `smuggler_params.<name>` for its params. See ParseInputAndConfig.
+	ConfigFile string          `json:"-"`
+	ConfigKeys map[string]bool `json:"-"`
 }
 
 type Version map[string]string
@@ -156,8 +402,10 @@ func NewVersions(sl []string) []Version {
 }
 
 type TaskParams struct {
-	SmugglerParams map[string]interface{} `json:"smuggler_params,omitempty"`
-	ExtraParams    map[string]interface{} `json:"-"`
+	SmugglerParams     map[string]interface{} `json:"smuggler_params,omitempty"`
+	SmugglerParamsFile string                 `json:"smuggler_params_file,omitempty"`
+	SmugglerDryRun     bool                   `json:"smuggler_dry_run,omitempty"`
+	ExtraParams        map[string]interface{} `json:"-"`
 }
 
 func NewResourceRequest(requestType RequestType, jsonString string) (*ResourceRequest, error) {
@@ -1,6 +1,11 @@
 package smuggler_test
 
 import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -113,3 +118,46 @@ var _ = Describe("NewVersion", func() {
 		Ω(b).Should(MatchJSON(`{"source":{},"version":{"ID": "{\"ID\": { \"a\": 1 } }"},"params":{}}`))
 	})
 })
+
+var _ = Describe("WrapCommandWithShell", func() {
+	var path string
+	BeforeEach(func() {
+		path = os.Getenv("PATH")
+	})
+	AfterEach(func() {
+		os.Setenv("PATH", path)
+	})
+
+	It("uses bash with strict flags", func() {
+		c, err := WrapCommandWithShell("check", "true", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c.Path).Should(HaveSuffix("/bash"))
+		Ω(c.Args).Should(Equal([]string{"-e", "-u", "-o", "pipefail", "-c", "true"}))
+	})
+
+	It("falls back to sh without bash only flags", func() {
+		dir, err := ioutil.TempDir("", "smuggler-path")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		sh, err := exec.LookPath("sh")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(os.Symlink(sh, filepath.Join(dir, "sh"))).Should(Succeed())
+		os.Setenv("PATH", dir)
+
+		c, err := WrapCommandWithShell("check", "true", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c.Path).Should(Equal(filepath.Join(dir, "sh")))
+		Ω(c.Args).Should(Equal([]string{"-e", "-u", "-c", "true"}))
+	})
+
+	It("fails when there is no shell", func() {
+		os.Setenv("PATH", "")
+		_, err := WrapCommandWithShell("check", "true", nil)
+		Ω(err).Should(MatchError("no shell found to run 'check': install bash or sh, or configure one in `shell`"))
+	})
+
+	It("fails when the interpreter of the shebang does not exist", func() {
+		_, err := WrapCommandWithShell("check", "#!/no/such/interpreter\ntrue", nil)
+		Ω(err).Should(MatchError(ContainSubstring("interpreter '/no/such/interpreter' for 'check' not found")))
+	})
+})
@@ -0,0 +1,209 @@
+package smuggler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+)
+
+// Names of the directory and file with the params in the output dir
+const (
+	ParamsDirName  = "params"
+	ParamsFileName = "params.json"
+)
+
+// Suffix of the params that are decoded from base64 into the params dir
+const Base64ParamSuffix = "_b64"
+
+// Default separator used when flattening nested params
+const DefaultFlattenSeparator = "_"
+
+// Flattens the nested maps and lists in params, so that
+// `aws: {region: x}` becomes `aws_region: x` and `tags: [a, b]`
+// becomes `tags_0: a`, `tags_1: b` and `tags_COUNT: 2`.
+// The original params are kept, and it fails if any flattened name
+// collides with an existing param or another flattened one.
+func flattenParams(params map[string]interface{}, separator string) (map[string]interface{}, error) {
+	if separator == "" {
+		separator = DefaultFlattenSeparator
+	}
+
+	origins := make(map[string]string)
+	flattened := make(map[string]interface{})
+
+	var flatten func(origin string, prefix string, v interface{}) error
+	add := func(origin string, name string, v interface{}) error {
+		if _, ok := params[name]; ok {
+			return fmt.Errorf(
+				"flattened param '%s' from '%s' collides with the param '%s'",
+				name, origin, name,
+			)
+		}
+		if other, ok := origins[name]; ok {
+			return fmt.Errorf(
+				"flattened param '%s' from '%s' collides with the one from '%s'",
+				name, origin, other,
+			)
+		}
+		origins[name] = origin
+		flattened[name] = v
+		return flatten(origin, name, v)
+	}
+	flatten = func(origin string, prefix string, v interface{}) error {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for _, k := range sortedKeys(v) {
+				if err := add(origin, prefix+separator+k, v[k]); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for i, e := range v {
+				if err := add(origin, fmt.Sprintf("%s%s%d", prefix, separator, i), e); err != nil {
+					return err
+				}
+			}
+			if err := add(origin, prefix+separator+"COUNT", len(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, k := range sortedKeys(params) {
+		if err := flatten(k, k, params[k]); err != nil {
+			return nil, err
+		}
+	}
+
+	return copyMaps(params, flattened), nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write the params as files in the params dir, one per param, and all of
+// them as JSON in the params file. The params with the suffix `_b64` are
+// also decoded into a file without the suffix.
+func writeParamsFiles(outputDir string, params map[string]interface{}, source SmugglerSource) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(outputDir, ParamsFileName), b, 0600)
+	if err != nil {
+		return err
+	}
+
+	paramsDir := filepath.Join(outputDir, ParamsDirName)
+	err = os.Mkdir(paramsDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	envNaming := source.EnvNaming()
+	names, err := envNaming.VarNames(params)
+	if err != nil {
+		return err
+	}
+	fileName := func(name string) string {
+		return filepath.Join(paramsDir, strings.TrimPrefix(name, envNaming.prefix()))
+	}
+
+	for k, v := range params {
+		err := ioutil.WriteFile(fileName(names[k]), []byte(InterfaceToJsonString(v)), 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	for k, v := range params {
+		encoded, ok := v.(string)
+		if !ok || !strings.HasSuffix(k, Base64ParamSuffix) {
+			continue
+		}
+		decodedKey := strings.TrimSuffix(k, Base64ParamSuffix)
+		if _, ok := params[decodedKey]; ok {
+			return fmt.Errorf("param '%s' would be decoded into the file of the param '%s', rename one of them", k, decodedKey)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return fmt.Errorf("decoding base64 param '%s': %s", k, err)
+		}
+		err = ioutil.WriteFile(fileName(envNaming.VarName(decodedKey)), decoded, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the params that must be passed as environment variables
+func selectEnvParams(params map[string]interface{}, paramsAsEnv *ParamsAsEnv) map[string]interface{} {
+	if paramsAsEnv == nil {
+		return params
+	}
+	result := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		if paramsAsEnv.Includes(k) {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// Merge the params from the YAML or JSON file `params.smuggler_params_file`,
+// relative to the sources dir of `out`, into the step params and the params
+// of the raw requests sent to the command.
+// The params defined in the step have priority.
+func loadParamsFile(sourcesDir string, request *ResourceRequest) error {
+	paramsFile := request.Params.SmugglerParamsFile
+	if paramsFile == "" {
+		return nil
+	}
+	if request.Type != OutType {
+		return fmt.Errorf("smuggler_params_file is only supported in 'put' steps, not in '%s'", request.Type)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(sourcesDir, paramsFile))
+	if err != nil {
+		return fmt.Errorf("reading smuggler_params_file: %s", err)
+	}
+	var fileParams map[string]interface{}
+	err = yaml.Unmarshal(content, &fileParams)
+	if err != nil {
+		return fmt.Errorf("parsing smuggler_params_file '%s': %s", paramsFile, err)
+	}
+
+	targets := []*map[string]interface{}{&request.Params.ExtraParams}
+	for _, raw := range []*RawResourceRequest{request.OrigRequest, request.FilteredRequest} {
+		if raw != nil {
+			targets = append(targets, &raw.Params)
+		}
+	}
+	for _, params := range targets {
+		merged, err := utils.MergeMaps(*params, copyMaps(fileParams))
+		if err != nil {
+			return err
+		}
+		if merged != nil {
+			*params = merged.(map[string]interface{})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ghodss/yaml"
+)
+
+// The parts of a concourse pipeline needed to build the requests of its
+// resources, e.g. to run them locally with `smuggler run`
+type Pipeline struct {
+	Resources []PipelineResource `json:"resources"`
+	Jobs      []Job              `json:"jobs"`
+}
+
+type PipelineResource struct {
+	Name   string                 `json:"name"`
+	Type   string                 `json:"type"`
+	Source map[string]interface{} `json:"source"`
+}
+
+type Job struct {
+	Name string `json:"name"`
+	Plan []Task `json:"plan"`
+}
+
+type Task struct {
+	GetName  string                 `json:"get"`
+	PutName  string                 `json:"put"`
+	Resource string                 `json:"resource"`
+	Params   map[string]interface{} `json:"params"`
+}
+
+// Name of the resource used by the step, which can be aliased with
+// `resource`
+func (t Task) ResourceName() string {
+	if t.Resource != "" {
+		return t.Resource
+	}
+	if t.GetName != "" {
+		return t.GetName
+	}
+	return t.PutName
+}
+
+func ParsePipeline(yamlManifest []byte) (*Pipeline, error) {
+	var pipeline Pipeline
+	err := yaml.Unmarshal(yamlManifest, &pipeline)
+	if err != nil {
+		return nil, err
+	}
+	return &pipeline, nil
+}
+
+func LoadPipeline(path string) (*Pipeline, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pipeline, err := ParsePipeline(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing pipeline '%s': %s", path, err)
+	}
+	return pipeline, nil
+}
+
+// Like ParsePipeline, but panics on errors. Useful for tests fixtures.
+func NewPipeline(yamlManifest string) *Pipeline {
+	pipeline, err := ParsePipeline([]byte(yamlManifest))
+	if err != nil {
+		panic(err)
+	}
+	return pipeline
+}
+
+// Builds the request that concourse would send to the resource: its
+// source, the params of the `get` or `put` step of the job for `in` or
+// `out`, and the version for `check` and `in`.
+func (pipeline *Pipeline) Request(requestType RequestType, resourceName string, jobName string, version Version) (*RawResourceRequest, error) {
+	var resource *PipelineResource
+	var request RawResourceRequest
+
+	for i, r := range pipeline.Resources {
+		if r.Name == resourceName {
+			resource = &pipeline.Resources[i]
+			break
+		}
+	}
+	if resource == nil {
+		return nil, fmt.Errorf("Cannot find a resource called '%s' in the pipeline.", resourceName)
+	}
+	request.Source = resource.Source
+
+	foundJob := jobName == ""
+	for _, j := range pipeline.Jobs {
+		if j.Name == jobName {
+			foundJob = true
+			for _, t := range j.Plan {
+				if t.ResourceName() != resourceName {
+					continue
+				}
+				if requestType == InType && t.GetName != "" {
+					request.Params = t.Params
+				}
+				if requestType == OutType && t.PutName != "" {
+					request.Params = t.Params
+				}
+			}
+		}
+	}
+
+	if !foundJob {
+		return nil, fmt.Errorf("Cannot find a job called '%s' in the pipeline.", jobName)
+	}
+
+	if requestType == InType || requestType == CheckType {
+		request.Version = version
+	}
+
+	return &request, nil
+}
+
+// The JSON request for the version, as the `ID` or as JSON, see NewVersion
+func (pipeline *Pipeline) JsonRequest(requestType RequestType, resourceName string, jobName string, version string) (string, error) {
+	request, err := pipeline.Request(requestType, resourceName, jobName, *NewVersion(version))
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("Failed encoding request %q: %+v", err, request)
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,38 @@
+package smuggler_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+var _ = Describe("Pipeline", func() {
+	It("builds the request of check with the source and version", func() {
+		request, err := pipeline.Request(CheckType, "complex_command", "", Version{"ID": "1.2.3"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(request.Source).Should(HaveKey("commands"))
+		Ω(request.Version).Should(Equal(Version{"ID": "1.2.3"}))
+		Ω(request.Params).Should(BeNil())
+	})
+
+	It("uses the params of the put step of the job for out", func() {
+		request, err := pipeline.Request(OutType, "complex_command", "a_job", Version{"ID": "1.2.3"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(request.Params).Should(HaveKeyWithValue("param4", "val4"))
+		Ω(request.Version).Should(BeNil())
+	})
+
+	It("finds the steps with aliased resources", func() {
+		request, err := pipeline.Request(InType, "complex_command", "aliased_job", Version{"ID": "1.2.3"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(request.Params).Should(HaveKeyWithValue("param4", "from_alias"))
+	})
+
+	It("fails with unknown resources or jobs", func() {
+		_, err := pipeline.Request(InType, "unknown", "a_job", nil)
+		Ω(err).Should(MatchError("Cannot find a resource called 'unknown' in the pipeline."))
+		_, err = pipeline.Request(InType, "complex_command", "unknown", nil)
+		Ω(err).Should(MatchError("Cannot find a job called 'unknown' in the pipeline."))
+	})
+})
@@ -0,0 +1,213 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+)
+
+// Directory with the plugins, overridden with SMUGGLER_PLUGINS_DIR
+const DefaultPluginsDir = "/opt/resource/plugins"
+
+// Name of the manifest in the directory of each plugin
+const PluginManifestFileName = "manifest.yml"
+
+// Version of the JSON sent to the plugins via stdin
+const PluginProtocol = "smuggler-plugin/v1"
+
+// Manifest of a plugin, in `<plugins dir>/<name>/manifest.yml`
+type PluginManifest struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Command     string                 `json:"command,omitempty"`
+	Actions     []RequestType          `json:"actions"`
+	Params      map[string]PluginParam `json:"params,omitempty"`
+	// Absolute path of the executable
+	Path string `json:"-"`
+}
+
+// Schema of an argument of the plugin in `with`
+type PluginParam struct {
+	Type        string `json:"type,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Request sent to the plugins via stdin, instead of the concourse request
+type PluginRequest struct {
+	Protocol  string                 `json:"protocol"`
+	Action    RequestType            `json:"action"`
+	With      map[string]interface{} `json:"with"`
+	Source    map[string]interface{} `json:"source"`
+	Params    map[string]interface{} `json:"params"`
+	Version   Version                `json:"version,omitempty"`
+	Dir       string                 `json:"dir,omitempty"`
+	OutputDir string                 `json:"output_dir"`
+}
+
+func PluginsDir() string {
+	return utils.GetEnvOrDefault("SMUGGLER_PLUGINS_DIR", DefaultPluginsDir)
+}
+
+// Returns the plugins in the plugins dir, sorted by name
+func DiscoverPlugins() ([]*PluginManifest, error) {
+	dir := PluginsDir()
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var plugins []*PluginManifest
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		manifest, err := readPluginManifest(filepath.Join(dir, e.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid plugin in '%s': %s", filepath.Join(dir, e.Name()), err)
+		}
+		plugins = append(plugins, manifest)
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Name < plugins[j].Name })
+	return plugins, nil
+}
+
+func readPluginManifest(pluginDir string) (*PluginManifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(pluginDir, PluginManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	var manifest PluginManifest
+	if err := yaml.Unmarshal(b, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Name == "" {
+		manifest.Name = filepath.Base(pluginDir)
+	}
+	if manifest.Command == "" {
+		manifest.Command = "plugin"
+	}
+	manifest.Path, err = filepath.Abs(filepath.Join(pluginDir, manifest.Command))
+	if err != nil {
+		return nil, err
+	}
+	for name, p := range manifest.Params {
+		switch p.Type {
+		case "", "string", "number", "boolean", "object", "array":
+		default:
+			return nil, fmt.Errorf("invalid type '%s' of param '%s'", p.Type, name)
+		}
+	}
+	return &manifest, nil
+}
+
+func FindPlugin(name string) (*PluginManifest, error) {
+	plugins, err := DiscoverPlugins()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(plugins))
+	for _, p := range plugins {
+		if p.Name == name {
+			return p, nil
+		}
+		names = append(names, p.Name)
+	}
+	return nil, fmt.Errorf("unknown plugin '%s' in '%s', found: [%s]", name, PluginsDir(), strings.Join(names, ", "))
+}
+
+func (manifest *PluginManifest) SupportsAction(action RequestType) bool {
+	for _, a := range manifest.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the arguments in `with` against the params of the manifest
+func (manifest *PluginManifest) ValidateArgs(with map[string]interface{}) error {
+	for _, name := range sortedKeys(with) {
+		if _, ok := manifest.Params[name]; !ok {
+			return fmt.Errorf("plugin '%s' does not accept the argument '%s'", manifest.Name, name)
+		}
+	}
+	names := make([]string, 0, len(manifest.Params))
+	for name := range manifest.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := manifest.Params[name]
+		v, ok := with[name]
+		if !ok {
+			if p.Required {
+				return fmt.Errorf("plugin '%s' requires the argument '%s'", manifest.Name, name)
+			}
+			continue
+		}
+		if p.Type != "" && queryTypeName(v) != p.Type {
+			return fmt.Errorf("argument '%s' of plugin '%s' must be a %s, not %s",
+				name, manifest.Name, p.Type, queryTypeName(v))
+		}
+	}
+	return nil
+}
+
+// Resolve the plugin of the command definition and validate its arguments
+func resolvePluginCommand(c *CommandDefinition) error {
+	manifest, err := FindPlugin(c.Plugin)
+	if err != nil {
+		return err
+	}
+	if err := manifest.ValidateArgs(c.With); err != nil {
+		return err
+	}
+	c.Path = manifest.Path
+	return nil
+}
+
+func validatePluginAction(c *CommandDefinition, action RequestType) error {
+	manifest, err := FindPlugin(c.Plugin)
+	if err != nil {
+		return err
+	}
+	if !manifest.SupportsAction(action) {
+		return fmt.Errorf("plugin '%s' does not support %s", manifest.Name, action)
+	}
+	return nil
+}
+
+// The request sent to the plugin via stdin
+func preparePluginRequest(c *CommandDefinition, dataDir string, outputDir string, request *ResourceRequest) ([]byte, error) {
+	r := PluginRequest{
+		Protocol:  PluginProtocol,
+		Action:    request.Type,
+		With:      c.With,
+		Source:    copyMaps(request.Source.SmugglerParams, request.Source.ExtraParams),
+		Params:    copyMaps(request.Params.SmugglerParams, request.Params.ExtraParams),
+		Version:   request.Version,
+		Dir:       dataDir,
+		OutputDir: outputDir,
+	}
+	if request.Type == CheckType {
+		r.Dir = ""
+	}
+	if r.With == nil {
+		r.With = map[string]interface{}{}
+	}
+	return json.Marshal(r)
+}
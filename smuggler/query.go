@@ -0,0 +1,1682 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A compiled query in a small language with the syntax of jq, to extract
+// and transform JSON documents without external tools. It is not jq, only
+// the documented subset is supported, see "Querying JSON" in the README.
+//
+// Supported: `.`, `..`, `.foo`, `."foo"`, `.[expr]`, `.[n:m]`, `.[]`, `?`,
+// `|`, `,`, `//`, `and`, `or`, comparisons, `+ - * / %`, literals, array
+// and object construction, `if/elif/else/end`, `$ENV` and the builtins
+// in queryBuiltins.
+type Query struct {
+	source string
+	root   queryNode
+}
+
+// A node of the query returns all the outputs for the given input
+type queryNode func(input interface{}) ([]interface{}, error)
+
+func CompileQuery(source string) (*Query, error) {
+	tokens, err := lexQuery(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query '%s': %s", source, err)
+	}
+	p := &queryParser{tokens: tokens}
+	root, err := p.parsePipe()
+	if err == nil && !p.done() {
+		err = fmt.Errorf("unexpected '%s'", p.peek().text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid query '%s': %s", source, err)
+	}
+	return &Query{source: source, root: root}, nil
+}
+
+func (q *Query) String() string {
+	return q.source
+}
+
+// Run the query on a document decoded from JSON, returning all the outputs
+func (q *Query) Run(input interface{}) ([]interface{}, error) {
+	return q.root(input)
+}
+
+// Run the query expecting exactly one output
+func (q *Query) RunOne(input interface{}) (interface{}, error) {
+	outputs, err := q.Run(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(outputs) != 1 {
+		return nil, fmt.Errorf("query '%s' must return exactly one value, returned %d", q.source, len(outputs))
+	}
+	return outputs[0], nil
+}
+
+//
+// Lexer
+//
+
+type queryTokenKind int
+
+const (
+	tokenPunct queryTokenKind = iota
+	tokenField
+	tokenIdent
+	tokenVariable
+	tokenString
+	tokenNumber
+)
+
+type queryToken struct {
+	kind  queryTokenKind
+	text  string
+	value interface{}
+}
+
+var queryPuncts = []string{
+	"..", "//", "==", "!=", "<=", ">=",
+	".", "[", "]", "{", "}", "(", ")", "|", ",", ":", ";", "?",
+	"<", ">", "+", "-", "*", "/", "%",
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func lexQuery(s string) ([]queryToken, error) {
+	var tokens []queryToken
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == '.' && i+1 < len(s) && isIdentStart(s[i+1]):
+			j := i + 1
+			for j < len(s) && isIdentChar(s[j]) {
+				j++
+			}
+			tokens = append(tokens, queryToken{kind: tokenField, text: s[i:j], value: s[i+1 : j]})
+			i = j
+		case c == '$' || isIdentStart(c):
+			j := i + 1
+			for j < len(s) && isIdentChar(s[j]) {
+				j++
+			}
+			kind := tokenIdent
+			if c == '$' {
+				kind = tokenVariable
+			}
+			tokens = append(tokens, queryToken{kind: kind, text: s[i:j]})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == 'e' || s[j] == 'E' ||
+				((s[j] == '+' || s[j] == '-') && (s[j-1] == 'e' || s[j-1] == 'E'))) {
+				j++
+			}
+			n, err := strconv.ParseFloat(s[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number '%s'", s[i:j])
+			}
+			tokens = append(tokens, queryToken{kind: tokenNumber, text: s[i:j], value: n})
+			i = j
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			var str string
+			if err := json.Unmarshal([]byte(s[i:j+1]), &str); err != nil {
+				return nil, fmt.Errorf("invalid string %s", s[i:j+1])
+			}
+			tokens = append(tokens, queryToken{kind: tokenString, text: s[i : j+1], value: str})
+			i = j + 1
+		default:
+			found := false
+			for _, p := range queryPuncts {
+				if strings.HasPrefix(s[i:], p) {
+					tokens = append(tokens, queryToken{kind: tokenPunct, text: p})
+					i += len(p)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character '%c'", c)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+//
+// Parser, which builds the tree of nodes to evaluate
+//
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *queryParser) peek() queryToken {
+	if p.done() {
+		return queryToken{kind: tokenPunct, text: "end of query"}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) isPunct(text string) bool {
+	t := p.peek()
+	return !p.done() && t.kind == tokenPunct && t.text == text
+}
+
+func (p *queryParser) isKeyword(text string) bool {
+	t := p.peek()
+	return !p.done() && t.kind == tokenIdent && t.text == text
+}
+
+func (p *queryParser) expect(text string) error {
+	if !p.isPunct(text) && !p.isKeyword(text) {
+		return fmt.Errorf("expected '%s' but found '%s'", text, p.peek().text)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *queryParser) parsePipe() (queryNode, error) {
+	left, err := p.parseComma()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isPunct("|") {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.parsePipe()
+	if err != nil {
+		return nil, err
+	}
+	return pipeNode(left, right), nil
+}
+
+func (p *queryParser) parseComma() (queryNode, error) {
+	left, err := p.parseAlternative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct(",") {
+		p.pos++
+		right, err := p.parseAlternative()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(input interface{}) ([]interface{}, error) {
+			lefts, err := l(input)
+			if err != nil {
+				return nil, err
+			}
+			rights, err := right(input)
+			if err != nil {
+				return nil, err
+			}
+			return append(lefts, rights...), nil
+		}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAlternative() (queryNode, error) {
+	left, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isPunct("//") {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.parseAlternative()
+	if err != nil {
+		return nil, err
+	}
+	return func(input interface{}) ([]interface{}, error) {
+		// Errors in the left side are ignored, like in jq
+		lefts, _ := left(input)
+		var outputs []interface{}
+		for _, l := range lefts {
+			if isTruthy(l) {
+				outputs = append(outputs, l)
+			}
+		}
+		if len(outputs) > 0 {
+			return outputs, nil
+		}
+		return right(input)
+	}, nil
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	return p.parseBoolean("or", p.parseAnd, func(l, r bool) bool { return l || r })
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	return p.parseBoolean("and", p.parseComparison, func(l, r bool) bool { return l && r })
+}
+
+func (p *queryParser) parseBoolean(keyword string, next func() (queryNode, error), op func(l, r bool) bool) (queryNode, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword(keyword) {
+		p.pos++
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode(left, right, func(l, r interface{}) (interface{}, error) {
+			return op(isTruthy(l), isTruthy(r)), nil
+		})
+	}
+	return left, nil
+}
+
+var comparisonOperators = map[string]func(c int) bool{
+	"==": func(c int) bool { return c == 0 },
+	"!=": func(c int) bool { return c != 0 },
+	"<":  func(c int) bool { return c < 0 },
+	"<=": func(c int) bool { return c <= 0 },
+	">":  func(c int) bool { return c > 0 },
+	">=": func(c int) bool { return c >= 0 },
+}
+
+func (p *queryParser) parseComparison() (queryNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	op, ok := comparisonOperators[t.text]
+	if !ok || t.kind != tokenPunct {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return binaryNode(left, right, func(l, r interface{}) (interface{}, error) {
+		return op(compareValues(l, r)), nil
+	}), nil
+}
+
+func (p *queryParser) parseAdditive() (queryNode, error) {
+	return p.parseArithmetic([]string{"+", "-"}, p.parseMultiplicative)
+}
+
+func (p *queryParser) parseMultiplicative() (queryNode, error) {
+	return p.parseArithmetic([]string{"*", "/", "%"}, p.parsePostfix)
+}
+
+func (p *queryParser) parseArithmetic(operators []string, next func() (queryNode, error)) (queryNode, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator := ""
+		for _, o := range operators {
+			if p.isPunct(o) {
+				operator = o
+			}
+		}
+		if operator == "" {
+			return left, nil
+		}
+		p.pos++
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode(left, right, func(l, r interface{}) (interface{}, error) {
+			return arithmetic(operator, l, r)
+		})
+	}
+}
+
+// Evaluates both sides with the same input and combines all their outputs
+func binaryNode(left, right queryNode, op func(l, r interface{}) (interface{}, error)) queryNode {
+	return func(input interface{}) ([]interface{}, error) {
+		rights, err := right(input)
+		if err != nil {
+			return nil, err
+		}
+		lefts, err := left(input)
+		if err != nil {
+			return nil, err
+		}
+		var outputs []interface{}
+		for _, r := range rights {
+			for _, l := range lefts {
+				v, err := op(l, r)
+				if err != nil {
+					return nil, err
+				}
+				outputs = append(outputs, v)
+			}
+		}
+		return outputs, nil
+	}
+}
+
+func (p *queryParser) parsePostfix() (queryNode, error) {
+	if p.isPunct("-") {
+		p.pos++
+		operand, err := p.parsePostfix()
+		if err != nil {
+			return nil, err
+		}
+		return mapNode(operand, func(v interface{}) (interface{}, error) {
+			return arithmetic("-", 0.0, v)
+		}), nil
+	}
+
+	term, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.peek().kind == tokenField:
+			term = pipeNode(term, fieldNode(p.peek().value.(string)))
+			p.pos++
+		case p.isPunct(".") && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].kind == tokenString:
+			term = pipeNode(term, fieldNode(p.tokens[p.pos+1].value.(string)))
+			p.pos += 2
+		case p.isPunct(".") && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].text == "[":
+			p.pos++
+		case p.isPunct("["):
+			suffix, err := p.parseBrackets()
+			if err != nil {
+				return nil, err
+			}
+			term = pipeNode(term, suffix)
+		case p.isPunct("?"):
+			p.pos++
+			term = tryNode(term)
+		default:
+			return term, nil
+		}
+	}
+}
+
+func pipeNode(left, right queryNode) queryNode {
+	return func(input interface{}) ([]interface{}, error) {
+		lefts, err := left(input)
+		if err != nil {
+			return nil, err
+		}
+		var outputs []interface{}
+		for _, l := range lefts {
+			rights, err := right(l)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, rights...)
+		}
+		return outputs, nil
+	}
+}
+
+func mapNode(node queryNode, f func(v interface{}) (interface{}, error)) queryNode {
+	return func(input interface{}) ([]interface{}, error) {
+		values, err := node(input)
+		if err != nil {
+			return nil, err
+		}
+		outputs := make([]interface{}, 0, len(values))
+		for _, v := range values {
+			o, err := f(v)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, o)
+		}
+		return outputs, nil
+	}
+}
+
+func tryNode(node queryNode) queryNode {
+	return func(input interface{}) ([]interface{}, error) {
+		outputs, err := node(input)
+		if err != nil {
+			return nil, nil
+		}
+		return outputs, nil
+	}
+}
+
+func identityNode(input interface{}) ([]interface{}, error) {
+	return []interface{}{input}, nil
+}
+
+func literalNode(v interface{}) queryNode {
+	return func(interface{}) ([]interface{}, error) {
+		return []interface{}{v}, nil
+	}
+}
+
+func fieldNode(name string) queryNode {
+	return func(input interface{}) ([]interface{}, error) {
+		v, err := indexValue(input, name)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{v}, nil
+	}
+}
+
+// Parses `[]`, `[expr]` and `[from:to]` after a term
+func (p *queryParser) parseBrackets() (queryNode, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	if p.isPunct("]") {
+		p.pos++
+		return iterateNode, nil
+	}
+
+	var from, to queryNode
+	var err error
+	if !p.isPunct(":") {
+		from, err = p.parsePipe()
+		if err != nil {
+			return nil, err
+		}
+		if p.isPunct("]") {
+			p.pos++
+			return func(input interface{}) ([]interface{}, error) {
+				indexes, err := from(input)
+				if err != nil {
+					return nil, err
+				}
+				outputs := make([]interface{}, 0, len(indexes))
+				for _, index := range indexes {
+					v, err := indexValue(input, index)
+					if err != nil {
+						return nil, err
+					}
+					outputs = append(outputs, v)
+				}
+				return outputs, nil
+			}, nil
+		}
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	if !p.isPunct("]") {
+		to, err = p.parsePipe()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	bound := func(node queryNode, input interface{}) (interface{}, error) {
+		if node == nil {
+			return nil, nil
+		}
+		return runOne(node, input)
+	}
+	return func(input interface{}) ([]interface{}, error) {
+		f, err := bound(from, input)
+		if err != nil {
+			return nil, err
+		}
+		t, err := bound(to, input)
+		if err != nil {
+			return nil, err
+		}
+		v, err := sliceValue(input, f, t)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{v}, nil
+	}, nil
+}
+
+func iterateNode(input interface{}) ([]interface{}, error) {
+	switch v := input.(type) {
+	case []interface{}:
+		return v, nil
+	case map[string]interface{}:
+		outputs := make([]interface{}, 0, len(v))
+		for _, k := range sortedKeys(v) {
+			outputs = append(outputs, v[k])
+		}
+		return outputs, nil
+	default:
+		return nil, fmt.Errorf("cannot iterate over %s", queryTypeName(input))
+	}
+}
+
+func recurseNode(input interface{}) ([]interface{}, error) {
+	outputs := []interface{}{input}
+	switch input.(type) {
+	case []interface{}, map[string]interface{}:
+		children, _ := iterateNode(input)
+		for _, c := range children {
+			descendants, _ := recurseNode(c)
+			outputs = append(outputs, descendants...)
+		}
+	}
+	return outputs, nil
+}
+
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	t := p.peek()
+	if p.done() {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+	switch t.kind {
+	case tokenField:
+		p.pos++
+		return fieldNode(t.value.(string)), nil
+	case tokenString, tokenNumber:
+		p.pos++
+		return literalNode(t.value), nil
+	case tokenVariable:
+		p.pos++
+		if t.text != "$ENV" {
+			return nil, fmt.Errorf("unknown variable '%s'", t.text)
+		}
+		return envNode, nil
+	case tokenIdent:
+		return p.parseIdent()
+	}
+
+	switch t.text {
+	case ".":
+		p.pos++
+		if p.peek().kind == tokenString {
+			name := p.peek().value.(string)
+			p.pos++
+			return fieldNode(name), nil
+		}
+		return identityNode, nil
+	case "..":
+		p.pos++
+		return recurseNode, nil
+	case "(":
+		p.pos++
+		node, err := p.parsePipe()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	case "[":
+		p.pos++
+		if p.isPunct("]") {
+			p.pos++
+			return literalNode([]interface{}{}), nil
+		}
+		node, err := p.parsePipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return func(input interface{}) ([]interface{}, error) {
+			values, err := node(input)
+			if err != nil {
+				return nil, err
+			}
+			if values == nil {
+				values = []interface{}{}
+			}
+			return []interface{}{values}, nil
+		}, nil
+	case "{":
+		return p.parseObject()
+	}
+	return nil, fmt.Errorf("unexpected '%s'", t.text)
+}
+
+func envNode(input interface{}) ([]interface{}, error) {
+	env := make(map[string]interface{})
+	for _, e := range os.Environ() {
+		kv := strings.SplitN(e, "=", 2)
+		env[kv[0]] = kv[1]
+	}
+	return []interface{}{env}, nil
+}
+
+func (p *queryParser) parseIdent() (queryNode, error) {
+	name := p.peek().text
+	p.pos++
+	switch name {
+	case "true":
+		return literalNode(true), nil
+	case "false":
+		return literalNode(false), nil
+	case "null":
+		return literalNode(nil), nil
+	case "if":
+		return p.parseIf()
+	case "env":
+		return envNode, nil
+	}
+
+	var args []queryNode
+	if p.isPunct("(") {
+		p.pos++
+		for {
+			arg, err := p.parsePipe()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if !p.isPunct(";") {
+				break
+			}
+			p.pos++
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	builtin, ok := queryBuiltins[fmt.Sprintf("%s/%d", name, len(args))]
+	if !ok {
+		return nil, fmt.Errorf("unknown function '%s/%d'", name, len(args))
+	}
+	return builtin(args), nil
+}
+
+func (p *queryParser) parseIf() (queryNode, error) {
+	cond, err := p.parsePipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("then"); err != nil {
+		return nil, err
+	}
+	then, err := p.parsePipe()
+	if err != nil {
+		return nil, err
+	}
+	var otherwise queryNode = identityNode
+	switch {
+	case p.isKeyword("elif"):
+		p.pos++
+		// The rest is parsed as a nested if, which consumes the `end`
+		return p.ifNode(cond, then)
+	case p.isKeyword("else"):
+		p.pos++
+		otherwise, err = p.parsePipe()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect("end"); err != nil {
+		return nil, err
+	}
+	return conditionalNode(cond, then, otherwise), nil
+}
+
+func (p *queryParser) ifNode(cond, then queryNode) (queryNode, error) {
+	otherwise, err := p.parseIf()
+	if err != nil {
+		return nil, err
+	}
+	return conditionalNode(cond, then, otherwise), nil
+}
+
+func conditionalNode(cond, then, otherwise queryNode) queryNode {
+	return func(input interface{}) ([]interface{}, error) {
+		conditions, err := cond(input)
+		if err != nil {
+			return nil, err
+		}
+		var outputs []interface{}
+		for _, c := range conditions {
+			branch := otherwise
+			if isTruthy(c) {
+				branch = then
+			}
+			values, err := branch(input)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, values...)
+		}
+		return outputs, nil
+	}
+}
+
+// Parses `{a: expr, "b": expr, (expr): expr, c}`
+func (p *queryParser) parseObject() (queryNode, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	type entry struct{ key, value queryNode }
+	var entries []entry
+	for !p.isPunct("}") {
+		t := p.peek()
+		var key queryNode
+		var shorthand queryNode
+		switch {
+		case t.kind == tokenIdent || t.kind == tokenString:
+			p.pos++
+			name := t.text
+			if t.kind == tokenString {
+				name = t.value.(string)
+			}
+			key = literalNode(name)
+			shorthand = fieldNode(name)
+		case t.kind == tokenVariable && t.text == "$ENV":
+			p.pos++
+			key = literalNode("ENV")
+			shorthand = envNode
+		case p.isPunct("("):
+			p.pos++
+			var err error
+			key, err = p.parsePipe()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected '%s' in object", t.text)
+		}
+
+		value := shorthand
+		if p.isPunct(":") || shorthand == nil {
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			var err error
+			value, err = p.parseAlternative()
+			if err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, entry{key, value})
+
+		if !p.isPunct(",") {
+			break
+		}
+		p.pos++
+	}
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+
+	return func(input interface{}) ([]interface{}, error) {
+		// Each key or value with several outputs multiplies the objects
+		objects := []map[string]interface{}{{}}
+		for _, e := range entries {
+			keys, err := e.key(input)
+			if err != nil {
+				return nil, err
+			}
+			values, err := e.value(input)
+			if err != nil {
+				return nil, err
+			}
+			var next []map[string]interface{}
+			for _, o := range objects {
+				for _, k := range keys {
+					ks, ok := k.(string)
+					if !ok {
+						return nil, fmt.Errorf("object keys must be strings, not %s", queryTypeName(k))
+					}
+					for _, v := range values {
+						n := make(map[string]interface{}, len(o)+1)
+						for ok, ov := range o {
+							n[ok] = ov
+						}
+						n[ks] = v
+						next = append(next, n)
+					}
+				}
+			}
+			objects = next
+		}
+		outputs := make([]interface{}, len(objects))
+		for i, o := range objects {
+			outputs[i] = o
+		}
+		return outputs, nil
+	}, nil
+}
+
+//
+// Values
+//
+
+func runOne(node queryNode, input interface{}) (interface{}, error) {
+	values, err := node(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 1 {
+		return nil, fmt.Errorf("expected one value, got %d", len(values))
+	}
+	return values[0], nil
+}
+
+func isTruthy(v interface{}) bool {
+	return !(v == nil || v == false)
+}
+
+func queryTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func indexValue(input interface{}, index interface{}) (interface{}, error) {
+	switch v := input.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		if k, ok := index.(string); ok {
+			return v[k], nil
+		}
+	case []interface{}:
+		if n, ok := index.(float64); ok {
+			i := int(math.Floor(n))
+			if i < 0 {
+				i += len(v)
+			}
+			if i < 0 || i >= len(v) {
+				return nil, nil
+			}
+			return v[i], nil
+		}
+	}
+	return nil, fmt.Errorf("cannot index %s with %s", queryTypeName(input), InterfaceToJsonString(index))
+}
+
+func sliceValue(input interface{}, from, to interface{}) (interface{}, error) {
+	length := 0
+	switch v := input.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		length = len(v)
+	case string:
+		length = len(v)
+	default:
+		return nil, fmt.Errorf("cannot slice %s", queryTypeName(input))
+	}
+	bound := func(b interface{}, def int) (int, error) {
+		if b == nil {
+			return def, nil
+		}
+		n, ok := b.(float64)
+		if !ok {
+			return 0, fmt.Errorf("slice indexes must be numbers")
+		}
+		i := int(math.Floor(n))
+		if i < 0 {
+			i += length
+		}
+		if i < 0 {
+			i = 0
+		}
+		if i > length {
+			i = length
+		}
+		return i, nil
+	}
+	f, err := bound(from, 0)
+	if err != nil {
+		return nil, err
+	}
+	t, err := bound(to, length)
+	if err != nil {
+		return nil, err
+	}
+	if t < f {
+		t = f
+	}
+	if s, ok := input.(string); ok {
+		return s[f:t], nil
+	}
+	return append([]interface{}{}, input.([]interface{})[f:t]...), nil
+}
+
+// Order of the values of different types, as in jq
+func queryTypeOrder(v interface{}) int {
+	switch v {
+	case nil:
+		return 0
+	case false:
+		return 1
+	case true:
+		return 2
+	}
+	switch v.(type) {
+	case float64:
+		return 3
+	case string:
+		return 4
+	case []interface{}:
+		return 5
+	}
+	return 6
+}
+
+func compareValues(a, b interface{}) int {
+	ta, tb := queryTypeOrder(a), queryTypeOrder(b)
+	if ta != tb {
+		return ta - tb
+	}
+	switch a := a.(type) {
+	case float64:
+		return compareFloats(a, b.(float64))
+	case string:
+		return strings.Compare(a, b.(string))
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := compareValues(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(b)
+	case map[string]interface{}:
+		b := b.(map[string]interface{})
+		ka, kb := sortedKeys(a), sortedKeys(b)
+		if c := compareValues(stringsToValues(ka), stringsToValues(kb)); c != 0 {
+			return c
+		}
+		for _, k := range ka {
+			if c := compareValues(a[k], b[k]); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func stringsToValues(l []string) []interface{} {
+	values := make([]interface{}, len(l))
+	for i, s := range l {
+		values[i] = s
+	}
+	return values
+}
+
+func arithmetic(operator string, l, r interface{}) (interface{}, error) {
+	if operator == "+" {
+		if l == nil {
+			return r, nil
+		}
+		if r == nil {
+			return l, nil
+		}
+	}
+	switch lv := l.(type) {
+	case float64:
+		if rv, ok := r.(float64); ok {
+			switch operator {
+			case "+":
+				return lv + rv, nil
+			case "-":
+				return lv - rv, nil
+			case "*":
+				return lv * rv, nil
+			case "/":
+				if rv == 0 {
+					return nil, fmt.Errorf("division by zero")
+				}
+				return lv / rv, nil
+			case "%":
+				if int(rv) == 0 {
+					return nil, fmt.Errorf("division by zero")
+				}
+				return float64(int(lv) % int(rv)), nil
+			}
+		}
+	case string:
+		if rv, ok := r.(string); ok {
+			switch operator {
+			case "+":
+				return lv + rv, nil
+			case "/":
+				return stringsToValues(strings.Split(lv, rv)), nil
+			}
+		}
+	case []interface{}:
+		if rv, ok := r.([]interface{}); ok {
+			switch operator {
+			case "+":
+				return append(append([]interface{}{}, lv...), rv...), nil
+			case "-":
+				result := []interface{}{}
+				for _, e := range lv {
+					found := false
+					for _, x := range rv {
+						if compareValues(e, x) == 0 {
+							found = true
+							break
+						}
+					}
+					if !found {
+						result = append(result, e)
+					}
+				}
+				return result, nil
+			}
+		}
+	case map[string]interface{}:
+		if rv, ok := r.(map[string]interface{}); ok && operator == "+" {
+			result := make(map[string]interface{}, len(lv)+len(rv))
+			for k, v := range lv {
+				result[k] = v
+			}
+			for k, v := range rv {
+				result[k] = v
+			}
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("%s and %s cannot be used with '%s'", queryTypeName(l), queryTypeName(r), operator)
+}
+
+//
+// Builtin functions, by `<name>/<number of arguments>`
+//
+
+type queryBuiltin func(args []queryNode) queryNode
+
+// Builtin taking no arguments and returning one value per input
+func simpleBuiltin(f func(input interface{}) (interface{}, error)) queryBuiltin {
+	return func([]queryNode) queryNode {
+		return func(input interface{}) ([]interface{}, error) {
+			v, err := f(input)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{v}, nil
+		}
+	}
+}
+
+// Builtin taking one argument, evaluated with the same input
+func argBuiltin(f func(input, arg interface{}) (interface{}, error)) queryBuiltin {
+	return func(args []queryNode) queryNode {
+		return func(input interface{}) ([]interface{}, error) {
+			values, err := args[0](input)
+			if err != nil {
+				return nil, err
+			}
+			outputs := make([]interface{}, 0, len(values))
+			for _, a := range values {
+				v, err := f(input, a)
+				if err != nil {
+					return nil, err
+				}
+				outputs = append(outputs, v)
+			}
+			return outputs, nil
+		}
+	}
+}
+
+func stringBuiltin(name string, f func(s string) interface{}) queryBuiltin {
+	return simpleBuiltin(func(input interface{}) (interface{}, error) {
+		s, ok := input.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s requires a string, not %s", name, queryTypeName(input))
+		}
+		return f(s), nil
+	})
+}
+
+func stringArgBuiltin(name string, f func(s, arg string) (interface{}, error)) queryBuiltin {
+	return argBuiltin(func(input, arg interface{}) (interface{}, error) {
+		s, ok1 := input.(string)
+		a, ok2 := arg.(string)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%s requires strings", name)
+		}
+		return f(s, a)
+	})
+}
+
+func arrayBuiltin(name string, f func(l []interface{}) (interface{}, error)) queryBuiltin {
+	return simpleBuiltin(func(input interface{}) (interface{}, error) {
+		l, ok := input.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s requires an array, not %s", name, queryTypeName(input))
+		}
+		return f(l)
+	})
+}
+
+// Sorts the array by the value of the node for each element
+func sortByNode(l []interface{}, node queryNode) ([]interface{}, error) {
+	type keyed struct {
+		key   interface{}
+		value interface{}
+	}
+	entries := make([]keyed, len(l))
+	for i, e := range l {
+		keys, err := node(e)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = keyed{append([]interface{}{}, keys...), e}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return compareValues(entries[i].key, entries[j].key) < 0
+	})
+	result := make([]interface{}, len(l))
+	for i, e := range entries {
+		result[i] = e.value
+	}
+	return result, nil
+}
+
+func toEntries(input interface{}) (interface{}, error) {
+	m, ok := input.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("to_entries requires an object, not %s", queryTypeName(input))
+	}
+	entries := make([]interface{}, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		entries = append(entries, map[string]interface{}{"key": k, "value": m[k]})
+	}
+	return entries, nil
+}
+
+func fromEntries(input interface{}) (interface{}, error) {
+	l, ok := input.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("from_entries requires an array, not %s", queryTypeName(input))
+	}
+	m := make(map[string]interface{}, len(l))
+	for _, e := range l {
+		entry, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("from_entries requires objects with key and value")
+		}
+		var key interface{}
+		for _, name := range []string{"key", "k", "name", "Name", "Key", "K"} {
+			if k, ok := entry[name]; ok && k != nil {
+				key = k
+				break
+			}
+		}
+		value, ok := entry["value"]
+		if !ok {
+			value = entry["v"]
+		}
+		switch k := key.(type) {
+		case string:
+			m[k] = value
+		case float64, bool:
+			m[InterfaceToJsonString(k)] = value
+		default:
+			return nil, fmt.Errorf("from_entries requires string keys")
+		}
+	}
+	return m, nil
+}
+
+func mapValues(input interface{}, f queryNode) (interface{}, error) {
+	switch v := input.(type) {
+	case []interface{}:
+		result := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			outputs, err := f(e)
+			if err != nil {
+				return nil, err
+			}
+			if len(outputs) > 0 {
+				result = append(result, outputs[0])
+			}
+		}
+		return result, nil
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			outputs, err := f(e)
+			if err != nil {
+				return nil, err
+			}
+			if len(outputs) > 0 {
+				result[k] = outputs[0]
+			}
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("cannot iterate over %s", queryTypeName(input))
+}
+
+var queryBuiltins map[string]queryBuiltin
+
+func init() {
+	queryBuiltins = map[string]queryBuiltin{
+		"empty/0": func([]queryNode) queryNode {
+			return func(interface{}) ([]interface{}, error) { return nil, nil }
+		},
+		"not/0": simpleBuiltin(func(input interface{}) (interface{}, error) {
+			return !isTruthy(input), nil
+		}),
+		"length/0": simpleBuiltin(func(input interface{}) (interface{}, error) {
+			switch v := input.(type) {
+			case nil:
+				return 0.0, nil
+			case string:
+				return float64(len([]rune(v))), nil
+			case []interface{}:
+				return float64(len(v)), nil
+			case map[string]interface{}:
+				return float64(len(v)), nil
+			case float64:
+				return math.Abs(v), nil
+			}
+			return nil, fmt.Errorf("%s has no length", queryTypeName(input))
+		}),
+		"keys/0": simpleBuiltin(func(input interface{}) (interface{}, error) {
+			switch v := input.(type) {
+			case map[string]interface{}:
+				return stringsToValues(sortedKeys(v)), nil
+			case []interface{}:
+				keys := make([]interface{}, len(v))
+				for i := range v {
+					keys[i] = float64(i)
+				}
+				return keys, nil
+			}
+			return nil, fmt.Errorf("%s has no keys", queryTypeName(input))
+		}),
+		"has/1": argBuiltin(func(input, key interface{}) (interface{}, error) {
+			switch v := input.(type) {
+			case map[string]interface{}:
+				if k, ok := key.(string); ok {
+					_, found := v[k]
+					return found, nil
+				}
+			case []interface{}:
+				if n, ok := key.(float64); ok {
+					return n >= 0 && int(n) < len(v), nil
+				}
+			}
+			return nil, fmt.Errorf("cannot check whether %s has a %s key", queryTypeName(input), queryTypeName(key))
+		}),
+		"type/0": simpleBuiltin(func(input interface{}) (interface{}, error) {
+			return queryTypeName(input), nil
+		}),
+		"select/1": func(args []queryNode) queryNode {
+			return func(input interface{}) ([]interface{}, error) {
+				conditions, err := args[0](input)
+				if err != nil {
+					return nil, err
+				}
+				var outputs []interface{}
+				for _, c := range conditions {
+					if isTruthy(c) {
+						outputs = append(outputs, input)
+					}
+				}
+				return outputs, nil
+			}
+		},
+		"map/1": func(args []queryNode) queryNode {
+			return func(input interface{}) ([]interface{}, error) {
+				values, err := iterateNode(input)
+				if err != nil {
+					return nil, err
+				}
+				result := []interface{}{}
+				for _, v := range values {
+					outputs, err := args[0](v)
+					if err != nil {
+						return nil, err
+					}
+					result = append(result, outputs...)
+				}
+				return []interface{}{result}, nil
+			}
+		},
+		"map_values/1": func(args []queryNode) queryNode {
+			return func(input interface{}) ([]interface{}, error) {
+				v, err := mapValues(input, args[0])
+				if err != nil {
+					return nil, err
+				}
+				return []interface{}{v}, nil
+			}
+		},
+		"to_entries/0":   simpleBuiltin(toEntries),
+		"from_entries/0": simpleBuiltin(fromEntries),
+		"with_entries/1": func(args []queryNode) queryNode {
+			return func(input interface{}) ([]interface{}, error) {
+				entries, err := toEntries(input)
+				if err != nil {
+					return nil, err
+				}
+				var mapped []interface{}
+				for _, e := range entries.([]interface{}) {
+					outputs, err := args[0](e)
+					if err != nil {
+						return nil, err
+					}
+					mapped = append(mapped, outputs...)
+				}
+				if mapped == nil {
+					mapped = []interface{}{}
+				}
+				v, err := fromEntries(mapped)
+				if err != nil {
+					return nil, err
+				}
+				return []interface{}{v}, nil
+			}
+		},
+		"add/0": arrayBuiltin("add", func(l []interface{}) (interface{}, error) {
+			var sum interface{}
+			for _, e := range l {
+				var err error
+				sum, err = arithmetic("+", sum, e)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return sum, nil
+		}),
+		"any/0": arrayBuiltin("any", func(l []interface{}) (interface{}, error) {
+			for _, e := range l {
+				if isTruthy(e) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}),
+		"all/0": arrayBuiltin("all", func(l []interface{}) (interface{}, error) {
+			for _, e := range l {
+				if !isTruthy(e) {
+					return false, nil
+				}
+			}
+			return true, nil
+		}),
+		"first/0": simpleBuiltin(func(input interface{}) (interface{}, error) {
+			return indexValue(input, 0.0)
+		}),
+		"last/0": simpleBuiltin(func(input interface{}) (interface{}, error) {
+			return indexValue(input, -1.0)
+		}),
+		"reverse/0": arrayBuiltin("reverse", func(l []interface{}) (interface{}, error) {
+			result := make([]interface{}, len(l))
+			for i, e := range l {
+				result[len(l)-1-i] = e
+			}
+			return result, nil
+		}),
+		"sort/0": arrayBuiltin("sort", func(l []interface{}) (interface{}, error) {
+			return sortByNode(l, identityNode)
+		}),
+		"sort_by/1": func(args []queryNode) queryNode {
+			return func(input interface{}) ([]interface{}, error) {
+				l, ok := input.([]interface{})
+				if !ok {
+					return nil, fmt.Errorf("sort_by requires an array, not %s", queryTypeName(input))
+				}
+				sorted, err := sortByNode(l, args[0])
+				if err != nil {
+					return nil, err
+				}
+				return []interface{}{sorted}, nil
+			}
+		},
+		"unique/0": arrayBuiltin("unique", func(l []interface{}) (interface{}, error) {
+			sorted, err := sortByNode(l, identityNode)
+			if err != nil {
+				return nil, err
+			}
+			result := []interface{}{}
+			for i, e := range sorted {
+				if i == 0 || compareValues(sorted[i-1], e) != 0 {
+					result = append(result, e)
+				}
+			}
+			return result, nil
+		}),
+		"min/0": arrayBuiltin("min", func(l []interface{}) (interface{}, error) {
+			var min interface{}
+			for i, e := range l {
+				if i == 0 || compareValues(e, min) < 0 {
+					min = e
+				}
+			}
+			return min, nil
+		}),
+		"max/0": arrayBuiltin("max", func(l []interface{}) (interface{}, error) {
+			var max interface{}
+			for i, e := range l {
+				if i == 0 || compareValues(e, max) >= 0 {
+					max = e
+				}
+			}
+			return max, nil
+		}),
+		"flatten/0": arrayBuiltin("flatten", func(l []interface{}) (interface{}, error) {
+			var flatten func(l []interface{}) []interface{}
+			flatten = func(l []interface{}) []interface{} {
+				result := []interface{}{}
+				for _, e := range l {
+					if nested, ok := e.([]interface{}); ok {
+						result = append(result, flatten(nested)...)
+					} else {
+						result = append(result, e)
+					}
+				}
+				return result
+			}
+			return flatten(l), nil
+		}),
+		"join/1": argBuiltin(func(input, separator interface{}) (interface{}, error) {
+			l, ok := input.([]interface{})
+			sep, sepOk := separator.(string)
+			if !ok || !sepOk {
+				return nil, fmt.Errorf("join requires an array and a string separator")
+			}
+			parts := make([]string, len(l))
+			for i, e := range l {
+				switch e := e.(type) {
+				case nil:
+				case string:
+					parts[i] = e
+				case float64, bool:
+					parts[i] = InterfaceToJsonString(e)
+				default:
+					return nil, fmt.Errorf("cannot join %s", queryTypeName(e))
+				}
+			}
+			return strings.Join(parts, sep), nil
+		}),
+		"contains/1": argBuiltin(func(input, element interface{}) (interface{}, error) {
+			return containsValue(input, element), nil
+		}),
+		"tostring/0": simpleBuiltin(func(input interface{}) (interface{}, error) {
+			if s, ok := input.(string); ok {
+				return s, nil
+			}
+			return InterfaceToJsonString(input), nil
+		}),
+		"tonumber/0": simpleBuiltin(func(input interface{}) (interface{}, error) {
+			switch v := input.(type) {
+			case float64:
+				return v, nil
+			case string:
+				n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+				if err != nil {
+					return nil, fmt.Errorf("cannot parse '%s' as a number", v)
+				}
+				return n, nil
+			}
+			return nil, fmt.Errorf("%s cannot be parsed as a number", queryTypeName(input))
+		}),
+		"tojson/0": simpleBuiltin(func(input interface{}) (interface{}, error) {
+			b, err := json.Marshal(input)
+			return string(b), err
+		}),
+		"fromjson/0": simpleBuiltin(func(input interface{}) (interface{}, error) {
+			s, ok := input.(string)
+			if !ok {
+				return nil, fmt.Errorf("fromjson requires a string, not %s", queryTypeName(input))
+			}
+			var v interface{}
+			if err := json.Unmarshal([]byte(s), &v); err != nil {
+				return nil, fmt.Errorf("cannot parse '%s' as JSON: %s", s, err)
+			}
+			return v, nil
+		}),
+		"ascii_downcase/0": stringBuiltin("ascii_downcase", func(s string) interface{} { return strings.ToLower(s) }),
+		"ascii_upcase/0":   stringBuiltin("ascii_upcase", func(s string) interface{} { return strings.ToUpper(s) }),
+		"startswith/1": stringArgBuiltin("startswith", func(s, prefix string) (interface{}, error) {
+			return strings.HasPrefix(s, prefix), nil
+		}),
+		"endswith/1": stringArgBuiltin("endswith", func(s, suffix string) (interface{}, error) {
+			return strings.HasSuffix(s, suffix), nil
+		}),
+		"ltrimstr/1": argBuiltin(func(input, prefix interface{}) (interface{}, error) {
+			s, ok1 := input.(string)
+			p, ok2 := prefix.(string)
+			if ok1 && ok2 {
+				return strings.TrimPrefix(s, p), nil
+			}
+			return input, nil
+		}),
+		"rtrimstr/1": argBuiltin(func(input, suffix interface{}) (interface{}, error) {
+			s, ok1 := input.(string)
+			p, ok2 := suffix.(string)
+			if ok1 && ok2 {
+				return strings.TrimSuffix(s, p), nil
+			}
+			return input, nil
+		}),
+		"split/1": stringArgBuiltin("split", func(s, separator string) (interface{}, error) {
+			return stringsToValues(strings.Split(s, separator)), nil
+		}),
+		"test/1": stringArgBuiltin("test", func(s, expr string) (interface{}, error) {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(s), nil
+		}),
+		"floor/0": simpleBuiltin(func(input interface{}) (interface{}, error) {
+			n, ok := input.(float64)
+			if !ok {
+				return nil, fmt.Errorf("floor requires a number, not %s", queryTypeName(input))
+			}
+			return math.Floor(n), nil
+		}),
+	}
+}
+
+func containsValue(a, b interface{}) bool {
+	switch av := a.(type) {
+	case string:
+		bv, ok := b.(string)
+		return ok && strings.Contains(av, bv)
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, be := range bv {
+			found := false
+			for _, ae := range av {
+				if containsValue(ae, be) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, be := range bv {
+			ae, found := av[k]
+			if !found || !containsValue(ae, be) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,248 @@
+package smuggler_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+var queryInput = `{
+	"source": {"bucket": "a_bucket", "region": "eu-west-1", "tags": ["a", "b"]},
+	"version": {"ref": "abc"},
+	"versions": [{"ref": "1", "n": 3}, {"ref": "2", "n": 1}, {"ref": "3", "n": 2}]
+}`
+
+func runQuery(query string) []interface{} {
+	var input interface{}
+	Ω(json.Unmarshal([]byte(queryInput), &input)).Should(Succeed())
+	q, err := CompileQuery(query)
+	Ω(err).ShouldNot(HaveOccurred())
+	outputs, err := q.Run(input)
+	Ω(err).ShouldNot(HaveOccurred())
+	return outputs
+}
+
+func queryOutputsJson(query string) string {
+	b, err := json.Marshal(runQuery(query))
+	Ω(err).ShouldNot(HaveOccurred())
+	return string(b)
+}
+
+var _ = Describe("Query", func() {
+	It("accesses fields and indexes", func() {
+		Ω(queryOutputsJson(`.source.bucket`)).Should(MatchJSON(`["a_bucket"]`))
+		Ω(queryOutputsJson(`."source"["region"]`)).Should(MatchJSON(`["eu-west-1"]`))
+		Ω(queryOutputsJson(`.source.tags[1], .source.tags[-1], .missing.field`)).Should(MatchJSON(`["b", "b", null]`))
+	})
+	It("slices and iterates arrays", func() {
+		Ω(queryOutputsJson(`.versions[0:2] | length`)).Should(MatchJSON(`[2]`))
+		Ω(queryOutputsJson(`.versions[].ref`)).Should(MatchJSON(`["1", "2", "3"]`))
+		Ω(queryOutputsJson(`.source.tags[:1]`)).Should(MatchJSON(`[["a"]]`))
+	})
+	It("constructs arrays and objects", func() {
+		Ω(queryOutputsJson(`{bucket: .source.bucket, "ref": .version.ref, (.source.region): 1}`)).Should(
+			MatchJSON(`[{"bucket": "a_bucket", "ref": "abc", "eu-west-1": 1}]`))
+		Ω(queryOutputsJson(`[.versions[] | {ref}]`)).Should(MatchJSON(`[[{"ref": "1"}, {"ref": "2"}, {"ref": "3"}]]`))
+	})
+	It("evaluates operators and conditionals", func() {
+		Ω(queryOutputsJson(`.versions | map(select(.n >= 2 and .ref != "3") | .ref)`)).Should(MatchJSON(`[["1"]]`))
+		Ω(queryOutputsJson(`.missing // "default"`)).Should(MatchJSON(`["default"]`))
+		Ω(queryOutputsJson(`.versions[0].n * 2 + 1, "a" + "b", -1`)).Should(MatchJSON(`[7, "ab", -1]`))
+		Ω(queryOutputsJson(`if .version.ref == "x" then 1 elif .version then 2 else 3 end`)).Should(MatchJSON(`[2]`))
+	})
+	It("supports the builtins", func() {
+		Ω(queryOutputsJson(`.versions | sort_by(.n) | map(.ref) | join(",")`)).Should(MatchJSON(`["2,3,1"]`))
+		Ω(queryOutputsJson(`.source | keys`)).Should(MatchJSON(`[["bucket", "region", "tags"]]`))
+		Ω(queryOutputsJson(`.source | with_entries(select(.key != "tags")) | to_entries | length`)).Should(MatchJSON(`[2]`))
+		Ω(queryOutputsJson(`.source | has("bucket"), (.bucket | test("^a_"))`)).Should(MatchJSON(`[true, true]`))
+		Ω(queryOutputsJson(`.versions | map(.n) | add, max, (map(tostring) | sort)`)).Should(MatchJSON(`[6, 3, ["1", "2", "3"]]`))
+	})
+	It("reads the environment from $ENV", func() {
+		os.Setenv("SMUGGLER_TEST_QUERY", "from env")
+		defer os.Unsetenv("SMUGGLER_TEST_QUERY")
+		Ω(queryOutputsJson(`$ENV.SMUGGLER_TEST_QUERY`)).Should(MatchJSON(`["from env"]`))
+	})
+	It("ignores errors with ?", func() {
+		Ω(queryOutputsJson(`.source.bucket[0]?`)).Should(MatchJSON(`null`))
+	})
+
+	It("returns an error for invalid queries", func() {
+		_, err := CompileQuery(`.source | unknown_function`)
+		Ω(err).Should(MatchError("invalid query '.source | unknown_function': unknown function 'unknown_function/0'"))
+		_, err = CompileQuery(`.[0`)
+		Ω(err).Should(HaveOccurred())
+	})
+	It("returns an error for the jq syntax that is not supported", func() {
+		for _, query := range []string{
+			`.a as $x | $x`,
+			`reduce .[] as $i (0; . + $i)`,
+			`def f: 1; f`,
+			`.a |= 1`,
+			`"a\(.a)"`,
+			`@base64`,
+		} {
+			_, err := CompileQuery(query)
+			Ω(err).Should(HaveOccurred(), query)
+		}
+	})
+	It("returns an error when a value can not be indexed", func() {
+		q, err := CompileQuery(`.[0]`)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = q.Run(map[string]interface{}{})
+		Ω(err).Should(MatchError("cannot index object with 0"))
+	})
+
+	Context("with the edge cases", func() {
+		var input interface{}
+		BeforeEach(func() {
+			Ω(json.Unmarshal([]byte(`{
+				"a": {"b": [1, 2, 3]}, "s": "str", "n": null, "num": 1.5, "t": true,
+				"o": {"x": 1, "y": "2"}, "e": [], "arr": [3, 1, 2, 1]
+			}`), &input)).Should(Succeed())
+		})
+		run := func(query string) (string, error) {
+			q, err := CompileQuery(query)
+			Ω(err).ShouldNot(HaveOccurred(), query)
+			outputs, err := q.Run(input)
+			if err != nil {
+				return "", err
+			}
+			b, err := json.Marshal(outputs)
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(b), nil
+		}
+
+		It("returns null for missing keys and indexes out of range", func() {
+			for _, c := range []struct{ query, outputs string }{
+				{`.missing`, `[null]`},
+				{`.n.a.b`, `[null]`},
+				{`.a.b[10], .a.b[-10]`, `[null, null]`},
+				{`.missing | length`, `[0]`},
+				{`.o.missing // "default"`, `["default"]`},
+				{`.n // .missing // false // "last"`, `["last"]`},
+				{`.e // 1`, `[[]]`},
+				{`$ENV.SMUGGLER_TEST_NOT_SET`, `[null]`},
+				{`.e | first, last, add, min`, `[null, null, null, null]`},
+			} {
+				outputs, err := run(c.query)
+				Ω(err).ShouldNot(HaveOccurred(), c.query)
+				Ω(outputs).Should(MatchJSON(c.outputs), c.query)
+			}
+		})
+
+		It("follows the jq semantics for the values of each type", func() {
+			for _, c := range []struct{ query, outputs string }{
+				{`.a.b[1:], .a.b[:-1], .s[1:3]`, `[[2, 3], [1, 2], "tr"]`},
+				{`.o[]`, `[1, "2"]`},
+				{`(.s | length), (.n | length), (.o | length)`, `[3, 0, 2]`},
+				{`[.t, .n, .num, .s, .o, .a.b] | sort`, `[[null, true, 1.5, "str", [1, 2, 3], {"x": 1, "y": "2"}]]`},
+				{`"a" < "b", [] < {}, null < false, 1 == 1.0`, `[true, true, true, true]`},
+				{`{"a": 1} + {"b": 2}, [1] + [2], null + 1`, `[{"a": 1, "b": 2}, [1, 2], 1]`},
+				{`7 / 2, 7 % 2, -.num`, `[3.5, 1, -1.5]`},
+				{`.arr | unique, min, max`, `[[1, 2, 3], 1, 3]`},
+				{`[1, [2, [3]]] | flatten`, `[[1, 2, 3]]`},
+				{`1, empty, 2`, `[1, 2]`},
+				{`[empty]`, `[[]]`},
+				{`.n | not`, `[true]`},
+				{`"{\"a\": 1}" | fromjson`, `[{"a": 1}]`},
+				{`(.num | tostring), (.o | tojson)`, `["1.5", "{\"x\":1,\"y\":\"2\"}"]`},
+				{`.num | ltrimstr("a")`, `[1.5]`},
+			} {
+				outputs, err := run(c.query)
+				Ω(err).ShouldNot(HaveOccurred(), c.query)
+				Ω(outputs).Should(MatchJSON(c.outputs), c.query)
+			}
+		})
+
+		It("returns an error for operations on the wrong types", func() {
+			for _, c := range []struct{ query, message string }{
+				{`.s.x`, "cannot index string with x"},
+				{`.num[0]`, "cannot index number with 0"},
+				{`.a.b.c`, "cannot index array with c"},
+				{`.s[]`, "cannot iterate over string"},
+				{`.n[]`, "cannot iterate over null"},
+				{`.s + 1`, "string and number cannot be used with '+'"},
+				{`.o - 1`, "object and number cannot be used with '-'"},
+				{`.s * "x"`, "string and string cannot be used with '*'"},
+				{`1 / 0`, "division by zero"},
+				{`5 % 0`, "division by zero"},
+				{`.t | length`, "boolean has no length"},
+				{`.num | keys`, "number has no keys"},
+				{`.s | has("a")`, "cannot check whether string has a string key"},
+				{`{(1): 2}`, "object keys must be strings, not number"},
+				{`.s | tonumber`, "cannot parse 'str' as a number"},
+				{`.s | fromjson`, "cannot parse 'str' as JSON: invalid character 's' looking for beginning of value"},
+				{`.o | join(",")`, "join requires an array and a string separator"},
+				{`.arr | from_entries`, "from_entries requires objects with key and value"},
+				{`.o | sort`, "sort requires an array, not object"},
+				{`.s | reverse`, "reverse requires an array, not string"},
+				{`.s | floor`, "floor requires a number, not string"},
+				{`.num | test("a")`, "test requires strings"},
+				{`.s | test("(")`, "error parsing regexp: missing closing ): `(`"},
+			} {
+				_, err := run(c.query)
+				Ω(err).Should(MatchError(c.message), c.query)
+			}
+		})
+
+		It("ignores the errors with ?", func() {
+			for _, query := range []string{`.s[]?`, `.n[]?`, `(.s.x)?`, `(.s | tonumber)?`} {
+				outputs, err := run(query)
+				Ω(err).ShouldNot(HaveOccurred(), query)
+				Ω(outputs).Should(Equal("null"), query)
+			}
+		})
+	})
+
+	It("returns an error for the syntax errors", func() {
+		for _, c := range []struct{ query, message string }{
+			{``, "unexpected end of query"},
+			{`.[`, "unexpected end of query"},
+			{`.a.`, "unexpected '.'"},
+			{`.a)`, "unexpected ')'"},
+			{`(.a`, "expected ')' but found 'end of query'"},
+			{`{`, "unexpected 'end of query' in object"},
+			{`{a:}`, "unexpected '}'"},
+			{`[1,`, "unexpected end of query"},
+			{`.a[]]`, "unexpected ']'"},
+			{`.[1:2:3]`, "expected ']' but found ':'"},
+			{`if . then 1`, "expected 'end' but found 'end of query'"},
+			{`"unterminated`, "unterminated string"},
+			{`"\u12"`, `invalid string "\u12"`},
+			{`1.2.3`, "invalid number '1.2.3'"},
+			{`$UNKNOWN`, "unknown variable '$UNKNOWN'"},
+			{`map(.a; .b)`, "unknown function 'map/2'"},
+		} {
+			_, err := CompileQuery(c.query)
+			Ω(err).Should(MatchError(fmt.Sprintf("invalid query '%s': %s", c.query, c.message)), c.query)
+		}
+	})
+
+	It("explains which jq syntax is not supported", func() {
+		for _, c := range []struct{ query, message string }{
+			{`.a as $x | $x`, "unexpected 'as'"},
+			{`reduce .[] as $i (0; . + $i)`, "unknown function 'reduce/0'"},
+			{`foreach .[] as $x (0; .)`, "unknown function 'foreach/0'"},
+			{`def f: .; f`, "unknown function 'def/0'"},
+			{`try .a catch 1`, "unknown function 'try/0'"},
+			{`label $out | 1`, "unknown function 'label/0'"},
+			{`.a = 1`, "unexpected character '='"},
+			{`.a |= 1`, "unexpected character '='"},
+			{`.a += 1`, "unexpected character '='"},
+			{`"a\(.a)"`, `invalid string "a\(.a)"`},
+			{`@base64`, "unexpected character '@'"},
+			{`path(.a)`, "unknown function 'path/1'"},
+			{`del(.a)`, "unknown function 'del/1'"},
+			{`getpath(["a"])`, "unknown function 'getpath/1'"},
+			{`test("a"; "i")`, "unknown function 'test/2'"},
+		} {
+			_, err := CompileQuery(c.query)
+			Ω(err).Should(MatchError(fmt.Sprintf("invalid query '%s': %s", c.query, c.message)), c.query)
+		}
+	})
+})
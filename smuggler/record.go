@@ -0,0 +1,349 @@
+package smuggler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+)
+
+// Directory to record every invocation into, as fixtures for `smuggler replay`
+const RecordDirEnv = "SMUGGLER_RECORD_DIR"
+
+// Environment variables which are not recorded, by name
+var sensitiveEnvRegexp = regexp.MustCompile(`(?i)(SECRET|PASSWORD|PASSWD|TOKEN|KEY|CREDENTIAL|AUTH|PRIVATE)`)
+
+// Environment variables restored by `smuggler replay`, as they are set by
+// concourse and used in the metadata
+var replayedEnvRegexp = regexp.MustCompile(`^(BUILD_|ATC_)`)
+
+const redactedValue = "***"
+
+// An invocation of the resource: its arguments and environment, the
+// request and the files in the input directory, and the response on
+// stdout or the error
+type Recording struct {
+	Action     RequestType     `json:"action"`
+	Args       []string        `json:"args"`
+	Env        []string        `json:"env"`
+	Request    json.RawMessage `json:"request"`
+	InputFiles []string        `json:"input_files,omitempty"`
+	Response   json.RawMessage `json:"response,omitempty"`
+	ExitStatus int             `json:"exit_status"`
+	Error      string          `json:"error,omitempty"`
+	RecordedAt time.Time       `json:"recorded_at"`
+}
+
+// Starts a recording if SMUGGLER_RECORD_DIR is set, nil otherwise. It
+// lists the input directory before the action changes it.
+func startRecording(requestType RequestType, dataDir string, input []byte) *Recording {
+	if os.Getenv(RecordDirEnv) == "" {
+		return nil
+	}
+	recording := &Recording{
+		Action:     requestType,
+		Args:       os.Args,
+		Env:        redactEnv(os.Environ()),
+		Request:    json.RawMessage(redactRequest(input)),
+		RecordedAt: time.Now().UTC(),
+	}
+	if dataDir != "" {
+		recording.InputFiles = listFiles(dataDir)
+	}
+	return recording
+}
+
+// Saves the recording with the response, or the error and exit status.
+// Failures are only logged, as they must not break the resource.
+func (recording *Recording) finish(logger *log.Logger, response interface{}, exitStatus int, err error) {
+	if recording == nil {
+		return
+	}
+	recording.ExitStatus = exitStatus
+	if err != nil {
+		recording.Error = err.Error()
+	} else {
+		recording.Response, _ = json.Marshal(response)
+	}
+
+	dir := os.Getenv(RecordDirEnv)
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.json",
+		recording.RecordedAt.Format("20060102T150405.000000000Z"), recording.Action))
+	b, err := json.MarshalIndent(recording, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(dir, 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(path, b, 0600)
+	}
+	if err != nil {
+		logger.Printf("[WARN] Failed to record the invocation in '%s': %s", path, err)
+		return
+	}
+	logger.Printf("[INFO] Recorded the invocation in '%s'", path)
+}
+
+func redactEnv(env []string) []string {
+	redacted := make([]string, 0, len(env))
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && sensitiveEnvRegexp.MatchString(parts[0]) {
+			kv = parts[0] + "=" + redactedValue
+		}
+		redacted = append(redacted, kv)
+	}
+	sort.Strings(redacted)
+	return redacted
+}
+
+// Replaces the values of the params in the source and params of a JSON
+// request, as they can be secrets interpolated by concourse. The smuggler
+// configuration is kept, but not the params in `smuggler_params` and in the
+// sources of the composite sub-resources.
+func redactRequest(input []byte) []byte {
+	var request map[string]interface{}
+	if err := json.Unmarshal(input, &request); err != nil {
+		b, _ := json.Marshal(redactedValue)
+		return b
+	}
+	if source, ok := request["source"].(map[string]interface{}); ok {
+		request["source"] = redactParams(source, SmugglerSource{})
+	}
+	if params, ok := request["params"].(map[string]interface{}); ok {
+		request["params"] = redactParams(params, TaskParams{})
+	}
+	b, _ := json.Marshal(request)
+	return b
+}
+
+func redactParams(m map[string]interface{}, config interface{}) map[string]interface{} {
+	configKeys := make(map[string]bool)
+	for _, t := range utils.ListJsonTagsOfStruct(config) {
+		if t != "" && t != "-" {
+			configKeys[t] = true
+		}
+	}
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		switch children, isMap := v.(map[string]interface{}); {
+		case k == "composite" && isMap:
+			redacted := make(map[string]interface{}, len(children))
+			for name, child := range children {
+				if source, ok := child.(map[string]interface{}); ok {
+					redacted[name] = redactParams(source, SmugglerSource{})
+				} else {
+					redacted[name] = redactValue(child)
+				}
+			}
+			result[k] = redacted
+		case configKeys[k] && k != "smuggler_params":
+			result[k] = v
+		default:
+			result[k] = redactValue(v)
+		}
+	}
+	return result
+}
+
+// Redacts every value in v, keeping the structure of maps and lists
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			result[k] = redactValue(e)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, e := range v {
+			result[i] = redactValue(e)
+		}
+		return result
+	case nil:
+		return nil
+	default:
+		return redactedValue
+	}
+}
+
+// Relative paths of the files in dir, directories with a trailing `/`
+func listFiles(dir string) []string {
+	var files []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if info.IsDir() {
+			rel += "/"
+		}
+		files = append(files, rel)
+		return nil
+	})
+	return files
+}
+
+func LoadRecording(path string) (*Recording, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var recording Recording
+	if err := json.Unmarshal(b, &recording); err != nil {
+		return nil, fmt.Errorf("parsing recording '%s': %s", path, err)
+	}
+	return &recording, nil
+}
+
+type ReplayResult struct {
+	Response   json.RawMessage
+	ExitStatus int
+	Stderr     string
+}
+
+// Whether the replay got the same response and exit status
+func (recording *Recording) Matches(result *ReplayResult) bool {
+	if recording.ExitStatus != result.ExitStatus {
+		return false
+	}
+	if recording.ExitStatus != 0 {
+		return true
+	}
+	var recorded, replayed interface{}
+	if json.Unmarshal(recording.Response, &recorded) != nil || json.Unmarshal(result.Response, &replayed) != nil {
+		return false
+	}
+	return reflect.DeepEqual(recorded, replayed)
+}
+
+// The differences between the recorded and the replayed exit status and
+// response, as lines prefixed by `-` (recorded) and `+` (replayed)
+func (recording *Recording) Diff(result *ReplayResult) []string {
+	recorded := []string{fmt.Sprintf("exit status %d", recording.ExitStatus)}
+	recorded = append(recorded, indentedJsonLines(recording.Response)...)
+	replayed := []string{fmt.Sprintf("exit status %d", result.ExitStatus)}
+	replayed = append(replayed, indentedJsonLines(result.Response)...)
+	return diffLines(recorded, replayed)
+}
+
+func indentedJsonLines(b []byte) []string {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, b, "", "  "); err != nil {
+		return strings.Split(string(b), "\n")
+	}
+	return strings.Split(out.String(), "\n")
+}
+
+// Line diff from the longest common subsequence of a and b. Common lines
+// are prefixed by two spaces, the ones only in a by `- ` and in b by `+ `.
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff = append(diff, "  "+a[i])
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	return diff
+}
+
+// Runs the recorded invocation again with the smuggler binary, in a new
+// directory with the recorded input files, empty, and the concourse
+// variables of the recorded environment.
+func (recording *Recording) Replay(binary string) (*ReplayResult, error) {
+	tmpDir, err := ioutil.TempDir("", "smuggler-replay")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	dataDir := filepath.Join(tmpDir, "dir")
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+	for _, f := range recording.InputFiles {
+		path := filepath.Join(dataDir, f)
+		if strings.HasSuffix(f, "/") {
+			err = os.MkdirAll(path, 0755)
+		} else if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			err = ioutil.WriteFile(path, nil, 0644)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	args := []string{string(recording.Action)}
+	if recording.Action != CheckType {
+		args = append(args, dataDir)
+	}
+	cmd := exec.Command(binary, args...)
+	cmd.Env = os.Environ()
+	for _, kv := range recording.Env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if replayedEnvRegexp.MatchString(name) && !strings.HasSuffix(kv, "="+redactedValue) {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		RecordDirEnv+"=",
+		ActionEnv+"=",
+		"SMUGGLER_LOG="+filepath.Join(tmpDir, "smuggler.log"),
+	)
+	cmd.Stdin = bytes.NewBuffer(recording.Request)
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+
+	result := &ReplayResult{
+		Response: json.RawMessage(bytes.TrimSpace(stdout.Bytes())),
+		Stderr:   stderr.String(),
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitStatus = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+	} else if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,79 @@
+package smuggler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+)
+
+// Names of the copies of the request in the output dir
+const (
+	RequestFileName         = "request.json"
+	FilteredRequestFileName = "filtered_request.json"
+)
+
+// Write a copy of the raw and filtered requests into the output dir,
+// so that several commands or subprocesses can read them.
+func writeRequestFiles(outputDir string, request *ResourceRequest) error {
+	files := map[string]*RawResourceRequest{
+		RequestFileName:         request.OrigRequest,
+		FilteredRequestFileName: request.FilteredRequest,
+	}
+	for name, r := range files {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(outputDir, name), b, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encode the request to send to the command via stdin, as defined
+// by `request_format`
+func prepareStdinRequest(request *ResourceRequest, params map[string]interface{}) ([]byte, error) {
+	switch request.Source.RequestFormat {
+	case RequestFormatNone:
+		return []byte{}, nil
+	case RequestFormatYaml:
+		jsonRequest, err := prepareJsonRequest(request)
+		if err != nil {
+			return nil, err
+		}
+		return yaml.JSONToYAML(jsonRequest)
+	case RequestFormatEnvFile:
+		return paramsToEnvFile(params, request.Source.EnvNaming())
+	default:
+		return prepareJsonRequest(request)
+	}
+}
+
+// Encode the params as `SMUGGLER_<name>='<value>'` lines, sorted by name
+// and quoted so that they can be sourced by a POSIX shell.
+func paramsToEnvFile(params map[string]interface{}, envNaming EnvNaming) ([]byte, error) {
+	env, err := envNaming.Env(params)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(env)
+
+	var b bytes.Buffer
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		b.WriteString(kv[0])
+		b.WriteString("=")
+		b.WriteString(utils.ShellQuote(kv[1]))
+		b.WriteString("\n")
+	}
+	return b.Bytes(), nil
+}
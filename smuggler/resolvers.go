@@ -0,0 +1,269 @@
+package smuggler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Resolves the argument of a `((<name>:<argument>))` placeholder
+// in source or params to its value
+type Resolver interface {
+	Resolve(argument string) (string, error)
+}
+
+type ResolverFunc func(argument string) (string, error)
+
+func (f ResolverFunc) Resolve(argument string) (string, error) {
+	return f(argument)
+}
+
+var placeholderRegexp = regexp.MustCompile(`\(\(([A-Za-z0-9_-]+):(.*?)\)\)`)
+
+var registeredResolvers = map[string]Resolver{
+	"file": ResolverFunc(func(path string) (string, error) {
+		b, err := ioutil.ReadFile(path)
+		return string(b), err
+	}),
+	"env": ResolverFunc(func(name string) (string, error) {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable '%s' is not defined", name)
+		}
+		return v, nil
+	}),
+	"cmd": ResolverFunc(func(commandLine string) (string, error) {
+		command, err := WrapCommandWithShell("cmd", commandLine, nil)
+		if err != nil {
+			return "", err
+		}
+		return CommandResolver{command}.run(nil)
+	}),
+	"base64": ResolverFunc(func(encoded string) (string, error) {
+		b, err := base64.StdEncoding.DecodeString(encoded)
+		return string(b), err
+	}),
+}
+
+// Register a resolver available in all the requests, for instance
+// from a resource implemented in go
+func RegisterResolver(name string, resolver Resolver) {
+	registeredResolvers[name] = resolver
+}
+
+// Resolver implemented by a command, which gets the argument as last
+// argument and as SMUGGLER_RESOLVE_ARG, and prints the value to stdout
+type CommandResolver struct {
+	Command *CommandDefinition
+}
+
+func (r CommandResolver) Resolve(argument string) (string, error) {
+	return r.run([]string{argument})
+}
+
+func (r CommandResolver) run(extraArgs []string) (string, error) {
+	args, cleanup, err := r.Command.prepareArgs(extraArgs...)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	cmd := exec.Command(r.Command.Path, args...)
+	cmd.Env = os.Environ()
+	if len(extraArgs) > 0 {
+		cmd.Env = append(cmd.Env, "SMUGGLER_RESOLVE_ARG="+extraArgs[len(extraArgs)-1])
+	}
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// Returns the resolvers declared in `resolvers`, with the same syntax
+// than `commands`, plus the registered ones
+func (source SmugglerSource) FindResolvers() (map[string]Resolver, error) {
+	resolvers := make(map[string]Resolver, len(registeredResolvers)+len(source.Resolvers))
+	for name, r := range registeredResolvers {
+		resolvers[name] = r
+	}
+	for name, cmd := range source.Resolvers {
+		var definition *CommandDefinition
+		switch cmd := cmd.(type) {
+		case string:
+			var err error
+			definition, err = WrapCommandWithShell(name, cmd, source.Shell)
+			if err != nil {
+				return nil, fmt.Errorf("invalid resolver '%s': %s", name, err)
+			}
+			// So that the argument is $1 in the shell script
+			if definition.script == "" {
+				definition.Args = append(definition.Args, name)
+			}
+		default:
+			var err error
+			definition, err = NewCommandDefinition(cmd)
+			if err != nil {
+				return nil, fmt.Errorf("invalid resolver '%s': %s", name, err)
+			}
+		}
+		resolvers[name] = CommandResolver{definition}
+	}
+	return resolvers, nil
+}
+
+type valueResolver struct {
+	resolvers     map[string]Resolver
+	cache         map[string]string
+	sensitive     []string
+	decryptionKey []byte
+}
+
+func newValueResolver(source SmugglerSource) (*valueResolver, error) {
+	resolvers, err := source.FindResolvers()
+	if err != nil {
+		return nil, err
+	}
+	return &valueResolver{
+		resolvers: resolvers,
+		cache:     make(map[string]string),
+	}, nil
+}
+
+// Decrypt the values encrypted with `smuggler encrypt`
+func (r *valueResolver) decrypt(s string) (string, error) {
+	if r.decryptionKey == nil {
+		var err error
+		r.decryptionKey, err = ReadDecryptionKey()
+		if err != nil {
+			return "", err
+		}
+	}
+	v, err := DecryptValue(r.decryptionKey, s)
+	if err != nil {
+		return "", err
+	}
+	if v != "" {
+		r.sensitive = append(r.sensitive, v)
+	}
+	return v, nil
+}
+
+func (r *valueResolver) resolveString(s string) (string, error) {
+	if IsEncryptedValue(s) {
+		return r.decrypt(s)
+	}
+	var resolveErr error
+	result := placeholderRegexp.ReplaceAllStringFunc(s, func(placeholder string) string {
+		if resolveErr != nil {
+			return placeholder
+		}
+		if v, ok := r.cache[placeholder]; ok {
+			return v
+		}
+		m := placeholderRegexp.FindStringSubmatch(placeholder)
+		name, argument := m[1], m[2]
+		resolver, ok := r.resolvers[name]
+		if !ok {
+			resolveErr = fmt.Errorf("unknown resolver '%s' in '%s'", name, placeholder)
+			return placeholder
+		}
+		v, err := resolver.Resolve(argument)
+		if err != nil {
+			resolveErr = fmt.Errorf("resolving '%s': %s", placeholder, err)
+			return placeholder
+		}
+		r.cache[placeholder] = v
+		if v != "" {
+			r.sensitive = append(r.sensitive, v)
+		}
+		return v
+	})
+	return result, resolveErr
+}
+
+func (r *valueResolver) resolve(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return r.resolveString(v)
+	case map[string]interface{}:
+		return r.resolveMap(v)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, e := range v {
+			var err error
+			result[i], err = r.resolve(e)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	default:
+		return v, nil
+	}
+}
+
+func (r *valueResolver) resolveMap(m map[string]interface{}) (map[string]interface{}, error) {
+	if m == nil {
+		return nil, nil
+	}
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		var err error
+		result[k], err = r.resolve(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Replace the placeholders and decrypt the encrypted values in the source
+// and params of the request, including the raw requests sent to the command.
+// Returns the resolved values, which must be considered sensitive.
+func resolveRequest(request *ResourceRequest) ([]string, error) {
+	r, err := newValueResolver(request.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	maps := []*map[string]interface{}{
+		&request.Source.SmugglerParams,
+		&request.Source.ExtraParams,
+		&request.Params.SmugglerParams,
+		&request.Params.ExtraParams,
+	}
+	for _, raw := range []*RawResourceRequest{request.OrigRequest, request.FilteredRequest} {
+		if raw != nil {
+			maps = append(maps, &raw.Source, &raw.Params)
+		}
+	}
+
+	for _, m := range maps {
+		// Do not resolve the definitions of the commands and resolvers
+		// in the raw requests
+		skipped := make(map[string]interface{})
+		for _, k := range []string{"commands", "resolvers"} {
+			if v, ok := (*m)[k]; ok {
+				skipped[k] = v
+				delete(*m, k)
+			}
+		}
+		resolved, err := r.resolveMap(*m)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range skipped {
+			resolved[k] = v
+		}
+		*m = resolved
+	}
+
+	return r.sensitive, nil
+}
@@ -0,0 +1,375 @@
+package smuggler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+)
+
+// A concourse resource. Implement it in go and call Main(resource) from
+// your `main()` to get the same plumbing than smuggler: dispatch by the
+// name of the binary or the arguments, request parsing, merge of
+// `smuggler.yml`, logging and response encoding.
+type Resource interface {
+	Check(ctx context.Context, request *ResourceRequest) ([]Version, error)
+	In(ctx context.Context, dir string, request *ResourceRequest) (*ResourceResponse, error)
+	Out(ctx context.Context, dir string, request *ResourceRequest) (*ResourceResponse, error)
+}
+
+// Error which makes Main exit with the given status instead of 1
+type ExitError struct {
+	Err    error
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+type contextKey string
+
+const loggerContextKey contextKey = "logger"
+
+// Returns the smuggler logger passed by Main to the resource
+func LoggerFromContext(ctx context.Context) *log.Logger {
+	if logger, ok := ctx.Value(loggerContextKey).(*log.Logger); ok {
+		return logger
+	}
+	return log.New(ioutil.Discard, "", 0)
+}
+
+func ContextWithLogger(ctx context.Context, logger *log.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, logger)
+}
+
+// Runs the resource as `check`, `in` or `out` depending on the arguments,
+// see ParseActionArguments, reading the request from stdin and writing
+// the response to stdout.
+func Main(resource Resource) {
+	defer utils.PrintRecover()
+
+	requestType, dataDir, err := ParseActionArguments(os.Args)
+	if err != nil {
+		utils.Sayf("usage: %s check|in|out [directory]\n", os.Args[0])
+		utils.Fatal("parsing arguments", err, 1)
+	}
+
+	input, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		utils.Panic("reading request from stdin: %s", err)
+	}
+
+	MainWithRequest(resource, requestType, dataDir, input)
+}
+
+// Runs the action with the given JSON request, as Main does with the one
+// in stdin: merges it with `smuggler.yml`, writes the response to stdout
+// and exits if it fails.
+func MainWithRequest(resource Resource, requestType RequestType, dataDir string, input []byte) {
+	defer utils.PrintRecover()
+
+	// Open Logger
+	tempFileLogger := OpenSmugglerLog()
+	logger := tempFileLogger.Logger
+
+	// Merge the request with the config file
+	configFile := FindSmugglerConfig(logger)
+	request := ParseInputAndConfig(requestType, input, ReadSmugglerConfig(configFile))
+	request.ConfigFile = configFile
+
+	// Dump logs to stderr if required
+	if request.Source.SmugglerDebug {
+		tempFileLogger.DupToStderr()
+		logger = tempFileLogger.Logger
+	}
+
+	logger.Printf(
+		"[INFO] Smuggler command called as:\n%s <<\"EOF\"\n%s\nEOF",
+		strings.Join(os.Args, " "),
+		utils.JsonPrettyPrint(input),
+	)
+
+	recording := startRecording(requestType, dataDir, input)
+
+	ctx := ContextWithLogger(context.Background(), logger)
+	response := ResourceResponse{Type: requestType}
+	var err error
+	switch requestType {
+	case CheckType:
+		response.Versions, err = resource.Check(ctx, request)
+	case InType:
+		var r *ResourceResponse
+		if r, err = resource.In(ctx, dataDir, request); r != nil {
+			response = *r
+		}
+	case OutType:
+		var r *ResourceResponse
+		if r, err = resource.Out(ctx, dataDir, request); r != nil {
+			response = *r
+		}
+	}
+
+	if err != nil {
+		// Fail even if the command succeeded but smuggler did not
+		exitStatus := 1
+		if exitErr, ok := err.(*ExitError); ok && exitErr.Status != 0 {
+			exitStatus = exitErr.Status
+		}
+		recording.finish(logger, nil, exitStatus, err)
+		utils.Fatal("running command", err, exitStatus)
+	}
+
+	response.Type = requestType
+	recording.finish(logger, responseOutput(&response), 0, nil)
+	outputResponse(&response)
+}
+
+// Environment variable to set the action, whatever the name of the binary.
+// Not SMUGGLER_ACTION, which is the `ACTION` param passed to the commands.
+const ActionEnv = "SMUGGLER_RESOURCE_ACTION"
+
+// Whether the binary is called as a resource action: with
+// SMUGGLER_RESOURCE_ACTION or with the name of the action.
+func CalledAsAction(args []string) bool {
+	return os.Getenv(ActionEnv) != "" || CalledAsActionName(args)
+}
+
+// Whether the name of the binary is `check`, `in` or `out`, like the links
+// in the image
+func CalledAsActionName(args []string) bool {
+	_, ok := actionFromName(filepath.Base(args[0]))
+	return ok
+}
+
+func UnknownActionError(action string) error {
+	return fmt.Errorf("unknown action '%s', must be one of: check, in, out", action)
+}
+
+func actionFromName(name string) (RequestType, bool) {
+	switch RequestType(name) {
+	case CheckType, InType, OutType:
+		return RequestType(name), true
+	}
+	return "", false
+}
+
+// Returns the action and the data directory from the arguments:
+// `SMUGGLER_RESOURCE_ACTION=<action> <binary> [dir]`, `check|in|out [dir]` or
+// `<binary> check|in|out [dir]`. `in` and `out` require the directory.
+func ParseActionArguments(args []string) (RequestType, string, error) {
+	var requestType RequestType
+	var rest []string
+	if action := os.Getenv(ActionEnv); action != "" {
+		var ok bool
+		if requestType, ok = actionFromName(action); !ok {
+			return "", "", fmt.Errorf("invalid %s '%s', must be one of: check, in, out", ActionEnv, action)
+		}
+		rest = args[1:]
+	} else if t, ok := actionFromName(filepath.Base(args[0])); ok {
+		requestType, rest = t, args[1:]
+	} else if len(args) > 1 {
+		if requestType, ok = actionFromName(args[1]); !ok {
+			return "", "", UnknownActionError(args[1])
+		}
+		rest = args[2:]
+	} else {
+		return "", "", fmt.Errorf("missing action, must be one of: check, in, out")
+	}
+
+	if requestType == CheckType {
+		return requestType, "", nil
+	}
+	if len(rest) < 1 {
+		dirName := "destination"
+		if requestType == OutType {
+			dirName = "sources"
+		}
+		return "", "", fmt.Errorf("missing %s directory for '%s'", dirName, requestType)
+	}
+	return requestType, rest[0], nil
+}
+
+// Opens the log in SMUGGLER_LOG, /tmp/smuggler.log by default
+func OpenSmugglerLog() *utils.TempFileLogger {
+	// Open Log file
+	smugglerLogFileName := utils.GetEnvOrDefault("SMUGGLER_LOG", "/tmp/smuggler.log")
+	tempFileLogger, err := utils.NewTempFileLogger(smugglerLogFileName)
+	if err != nil {
+		utils.Panic("opening log '%s': %s", smugglerLogFileName, err)
+	}
+	return tempFileLogger
+}
+
+func ParseInputAndConfig(requestType RequestType, input []byte, config []byte) *ResourceRequest {
+	var configKeys map[string]bool
+	if len(config) > 0 {
+		var requestCatchAll struct {
+			Source  map[string]interface{} `json:"source,omitempty"`
+			Version map[string]interface{} `json:"version,omitempty"`
+			Params  map[string]interface{} `json:"params,omitempty"`
+		}
+		var configCatchAll map[string]interface{}
+
+		err := json.Unmarshal(input, &requestCatchAll)
+		if err != nil {
+			utils.Panic("Error parsing request: %s", err)
+		}
+		err = yaml.Unmarshal(config, &configCatchAll)
+		if err != nil {
+			utils.Panic("Error parsing 'smuggler.yml': %s", err)
+		}
+
+		commands, err := utils.MergeMaps(requestCatchAll.Source["commands"], configCatchAll["commands"])
+		if err != nil {
+			utils.Panic("Format error in 'commands', is not a map: %s", err)
+		}
+		smuggler_params, err := utils.MergeMaps(requestCatchAll.Source["smuggler_params"], configCatchAll["smuggler_params"])
+		if err != nil {
+			utils.Panic("Format error in 'smuggler_params', is not a map: %s", err)
+		}
+
+		configKeys = make(map[string]bool)
+		requestParams, _ := requestCatchAll.Source["smuggler_params"].(map[string]interface{})
+		configParams, _ := configCatchAll["smuggler_params"].(map[string]interface{})
+		for k := range configParams {
+			if requestParams[k] == nil {
+				configKeys["smuggler_params."+k] = true
+			}
+		}
+
+		if requestCatchAll.Source == nil {
+			requestCatchAll.Source = make(map[string]interface{})
+		}
+		for k, v := range configCatchAll {
+			configKeys[k] = true
+			requestCatchAll.Source[k] = v
+		}
+		requestCatchAll.Source["commands"] = commands
+		requestCatchAll.Source["smuggler_params"] = smuggler_params
+
+		input, err = json.Marshal(&requestCatchAll)
+		if err != nil {
+			utils.Panic("Error merging 'smuggler.yml': %s", err)
+		}
+	}
+	request, err := NewResourceRequest(requestType, string(input))
+	if err != nil {
+		utils.Panic("Error parsing request from stdin: %s", err)
+	}
+	request.ConfigKeys = configKeys
+	return request
+}
+
+// Reads the `smuggler.yml` next to the binary or in SMUGGLER_CONFIG,
+// empty if there is none
+func FindAndReadSmugglerConfig(logger *log.Logger) []byte {
+	return ReadSmugglerConfig(FindSmugglerConfig(logger))
+}
+
+// Returns the path of the `smuggler.yml` in SMUGGLER_CONFIG, next to the
+// binary or in /opt/resource, empty if there is none. An explicit
+// SMUGGLER_CONFIG has priority, as it is set by `-config` and the tests.
+func FindSmugglerConfig(logger *log.Logger) string {
+	smugglerYmlPaths := []string{
+		filepath.Join(filepath.Dir(os.Args[0]), "smuggler.yml"),
+		"/opt/resource/smuggler.yml",
+	}
+	if explicit := os.Getenv("SMUGGLER_CONFIG"); explicit != "" {
+		smugglerYmlPaths = append([]string{explicit}, smugglerYmlPaths...)
+	}
+
+	smugglerConfigFile := ""
+OuterLoop:
+	for _, f := range smugglerYmlPaths {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			smugglerConfigFile = f
+			break OuterLoop
+		}
+	}
+	if smugglerConfigFile == "" {
+		logger.Printf("[INFO] No config file in any of: %s", strings.Join(smugglerYmlPaths, ", "))
+		return ""
+	}
+	logger.Printf("[INFO] Found config file %s", smugglerConfigFile)
+	return smugglerConfigFile
+}
+
+// Reads the config file, empty if the path is empty
+func ReadSmugglerConfig(smugglerConfigFile string) []byte {
+	if smugglerConfigFile == "" {
+		return []byte{}
+	}
+	content, err := ioutil.ReadFile(smugglerConfigFile)
+	if err != nil {
+		utils.Panic("Error reading '%s': %s", smugglerConfigFile, err)
+	}
+
+	return content
+}
+
+// The response as concourse expects it: the versions for check
+func responseOutput(response *ResourceResponse) interface{} {
+	if response.Type == CheckType {
+		return response.Versions
+	}
+	return response
+}
+
+// Send back response
+func outputResponse(response *ResourceResponse) {
+	if err := json.NewEncoder(os.Stdout).Encode(responseOutput(response)); err != nil {
+		utils.Panic("writing response to stdout: %s", err)
+	}
+}
+
+// Resource implemented by the commands in the smuggler config
+type CommandResource struct{}
+
+func (CommandResource) run(ctx context.Context, dir string, request *ResourceRequest) (*ResourceResponse, error) {
+	command := NewSmugglerCommand(LoggerFromContext(ctx))
+	response, err := command.RunAction(dir, request)
+
+	if command.Explanation != nil {
+		fmt.Fprintf(os.Stderr, "%s", command.Explanation)
+	}
+
+	// Print output to stderr
+	if len(command.LastCommandErr) > 0 {
+		fmt.Fprintf(os.Stderr, "Stderr:")
+		os.Stderr.Write(command.Redact(command.LastCommandErr))
+	}
+	if len(command.LastCommandOutput) > 0 {
+		fmt.Fprintf(os.Stderr, "Stdout:")
+		os.Stderr.Write(command.Redact(command.LastCommandOutput))
+	}
+
+	if err != nil && !command.LastCommandSuccess() {
+		err = &ExitError{Err: err, Status: command.LastCommandExitStatus()}
+	}
+	return response, err
+}
+
+func (r CommandResource) Check(ctx context.Context, request *ResourceRequest) ([]Version, error) {
+	response, err := r.run(ctx, "", request)
+	if response == nil {
+		return nil, err
+	}
+	return response.Versions, err
+}
+
+func (r CommandResource) In(ctx context.Context, dir string, request *ResourceRequest) (*ResourceResponse, error) {
+	return r.run(ctx, dir, request)
+}
+
+func (r CommandResource) Out(ctx context.Context, dir string, request *ResourceRequest) (*ResourceResponse, error) {
+	return r.run(ctx, dir, request)
+}
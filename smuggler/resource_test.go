@@ -0,0 +1,136 @@
+package smuggler_test
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+var _ = Describe("CommandResource", func() {
+	var resource Resource = CommandResource{}
+	var ctx = ContextWithLogger(context.Background(), logger)
+
+	newRequest := func(requestType RequestType, fixtureResourceName string) *ResourceRequest {
+		requestJson, err := pipeline.JsonRequest(requestType, fixtureResourceName, "a_job", "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+		request, err := NewResourceRequest(requestType, requestJson)
+		Ω(err).ShouldNot(HaveOccurred())
+		return request
+	}
+
+	It("runs the commands of the config", func() {
+		versions, err := resource.Check(ctx, newRequest(CheckType, "complex_command"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(versions).Should(Equal([]Version{{"ID": "1.2.3"}, {"ID": "1.2.4"}}))
+	})
+
+	It("returns the exit status of a failed command", func() {
+		_, err := resource.In(ctx, "/some/path", newRequest(InType, "fail_command"))
+		Ω(err).Should(BeAssignableToTypeOf(&ExitError{}))
+		Ω(err.(*ExitError).Status).Should(Equal(2))
+	})
+})
+
+var _ = Describe("FindSmugglerConfig", func() {
+	var binaryDir, explicit string
+	var args []string
+
+	BeforeEach(func() {
+		var err error
+		binaryDir, err = ioutil.TempDir("", "smuggler-binary")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.WriteFile(filepath.Join(binaryDir, "smuggler.yml"), []byte("{}"), 0644)).Should(Succeed())
+		explicit = filepath.Join(binaryDir, "explicit.yml")
+		Ω(ioutil.WriteFile(explicit, []byte("{}"), 0644)).Should(Succeed())
+
+		args = os.Args
+		os.Args = append([]string{filepath.Join(binaryDir, "check")}, os.Args[1:]...)
+	})
+	AfterEach(func() {
+		os.Args = args
+		os.Unsetenv("SMUGGLER_CONFIG")
+		os.RemoveAll(binaryDir)
+	})
+
+	It("gives priority to SMUGGLER_CONFIG over the smuggler.yml next to the binary", func() {
+		os.Setenv("SMUGGLER_CONFIG", explicit)
+		Ω(FindSmugglerConfig(logger)).Should(Equal(explicit))
+	})
+	It("uses the smuggler.yml next to the binary by default", func() {
+		os.Setenv("SMUGGLER_CONFIG", "")
+		Ω(FindSmugglerConfig(logger)).Should(Equal(filepath.Join(binaryDir, "smuggler.yml")))
+	})
+})
+
+var _ = Describe("LoggerFromContext", func() {
+	It("returns the logger in the context", func() {
+		Ω(LoggerFromContext(ContextWithLogger(context.Background(), logger))).Should(BeIdenticalTo(logger))
+	})
+	It("returns a logger that discards the messages by default", func() {
+		Ω(LoggerFromContext(context.Background())).Should(BeAssignableToTypeOf(&log.Logger{}))
+	})
+})
+
+var _ = Describe("ParseActionArguments", func() {
+	AfterEach(func() {
+		os.Unsetenv(ActionEnv)
+	})
+
+	It("uses the name of the binary when it is exactly an action", func() {
+		requestType, dir, err := ParseActionArguments([]string{"/opt/resource/in", "/tmp/dir"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(requestType).Should(Equal(InType))
+		Ω(dir).Should(Equal("/tmp/dir"))
+		Ω(CalledAsAction([]string{"/opt/resource/in"})).Should(BeTrue())
+	})
+
+	It("does not match names which only contain an action", func() {
+		_, _, err := ParseActionArguments([]string{"/usr/bin/login"})
+		Ω(err).Should(MatchError("missing action, must be one of: check, in, out"))
+		Ω(CalledAsAction([]string{"/usr/bin/login"})).Should(BeFalse())
+	})
+
+	It("uses the first argument as action", func() {
+		requestType, dir, err := ParseActionArguments([]string{"smuggler-main", "out", "/tmp/dir"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(requestType).Should(Equal(OutType))
+		Ω(dir).Should(Equal("/tmp/dir"))
+
+		requestType, dir, err = ParseActionArguments([]string{"smuggler", "check"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(requestType).Should(Equal(CheckType))
+		Ω(dir).Should(BeEmpty())
+	})
+
+	It("uses SMUGGLER_RESOURCE_ACTION over the name of the binary", func() {
+		os.Setenv(ActionEnv, "out")
+		requestType, dir, err := ParseActionArguments([]string{"/opt/resource/in", "/tmp/dir"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(requestType).Should(Equal(OutType))
+		Ω(dir).Should(Equal("/tmp/dir"))
+		Ω(CalledAsAction([]string{"smuggler"})).Should(BeTrue())
+	})
+
+	It("fails with unknown actions", func() {
+		_, _, err := ParseActionArguments([]string{"smuggler", "login"})
+		Ω(err).Should(MatchError("unknown action 'login', must be one of: check, in, out"))
+
+		os.Setenv(ActionEnv, "get")
+		_, _, err = ParseActionArguments([]string{"smuggler"})
+		Ω(err).Should(MatchError("invalid SMUGGLER_RESOURCE_ACTION 'get', must be one of: check, in, out"))
+	})
+
+	It("requires the directory for in and out", func() {
+		_, _, err := ParseActionArguments([]string{"smuggler", "in"})
+		Ω(err).Should(MatchError("missing destination directory for 'in'"))
+		_, _, err = ParseActionArguments([]string{"out"})
+		Ω(err).Should(MatchError("missing sources directory for 'out'"))
+	})
+})
@@ -0,0 +1,160 @@
+package smuggler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// Versions found by check, from the oldest to the newest, as concourse
+// keeps them
+type VersionHistory struct {
+	Versions []Version `json:"versions"`
+}
+
+// Loads the history from a JSON file, empty if it does not exist
+func LoadVersionHistory(path string) (*VersionHistory, error) {
+	history := &VersionHistory{}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, history); err != nil {
+		return nil, fmt.Errorf("parsing version history '%s': %s", path, err)
+	}
+	return history, nil
+}
+
+func (history *VersionHistory) Save(path string) error {
+	b, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// The newest version, nil if there is none
+func (history *VersionHistory) Latest() Version {
+	if len(history.Versions) == 0 {
+		return nil
+	}
+	return history.Versions[len(history.Versions)-1]
+}
+
+// Position of the version in the history, -1 if it is not there
+func (history *VersionHistory) Index(version Version) int {
+	for i, v := range history.Versions {
+		if reflect.DeepEqual(v, version) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Adds the versions returned by a check with the current version, and
+// returns the new ones and the problems of the response: not returning
+// the current version, or returning an older one as the newest.
+func (history *VersionHistory) Add(current Version, versions []Version) ([]Version, []string) {
+	var regressions []string
+	currentIndex := history.Index(current)
+
+	if current != nil {
+		found := false
+		for _, v := range versions {
+			if reflect.DeepEqual(v, current) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			regressions = append(regressions,
+				fmt.Sprintf("check did not return the current version %s", InterfaceToJsonString(current)))
+		}
+	}
+	if len(versions) > 0 {
+		newest := versions[len(versions)-1]
+		if i := history.Index(newest); i >= 0 && i < currentIndex {
+			regressions = append(regressions,
+				fmt.Sprintf("check went backwards: returned %s as newest, older than the current version %s",
+					InterfaceToJsonString(newest), InterfaceToJsonString(current)))
+		}
+	}
+
+	var added []Version
+	for _, v := range versions {
+		if history.Index(v) < 0 {
+			history.Versions = append(history.Versions, v)
+			added = append(added, v)
+		}
+	}
+	return added, regressions
+}
+
+// Runs check repeatedly as concourse does, feeding back the newest version
+// and keeping the history of versions. If InDir is set, runs `in` for the
+// new versions into `<InDir>/<position in the history>`.
+type Simulation struct {
+	Resource Resource
+	// Builds the request for the action and version
+	Request func(requestType RequestType, version Version) (*ResourceRequest, error)
+	History *VersionHistory
+	InDir   string
+}
+
+type SimulationIteration struct {
+	Number      int
+	Current     Version
+	Versions    []Version
+	New         []Version
+	InDirs      []string
+	Regressions []string
+}
+
+// Runs the iterations and calls report after each of them. Stops at the
+// first error of check or in.
+func (s *Simulation) Run(ctx context.Context, iterations int, report func(*SimulationIteration)) error {
+	for n := 1; n <= iterations; n++ {
+		iteration := &SimulationIteration{Number: n, Current: s.History.Latest()}
+
+		request, err := s.Request(CheckType, iteration.Current)
+		if err != nil {
+			return err
+		}
+		iteration.Versions, err = s.Resource.Check(ctx, request)
+		if err != nil {
+			return fmt.Errorf("check #%d failed: %s", n, err)
+		}
+		iteration.New, iteration.Regressions = s.History.Add(iteration.Current, iteration.Versions)
+
+		if s.InDir != "" {
+			for _, v := range iteration.New {
+				dir := filepath.Join(s.InDir, fmt.Sprintf("%d", s.History.Index(v)+1))
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					return err
+				}
+				request, err := s.Request(InType, v)
+				if err != nil {
+					return err
+				}
+				response, err := s.Resource.In(ctx, dir, request)
+				if err != nil {
+					return fmt.Errorf("in of %s failed: %s", InterfaceToJsonString(v), err)
+				}
+				if response != nil && !reflect.DeepEqual(response.Version, v) {
+					iteration.Regressions = append(iteration.Regressions,
+						fmt.Sprintf("in of %s returned the version %s", InterfaceToJsonString(v), InterfaceToJsonString(response.Version)))
+				}
+				iteration.InDirs = append(iteration.InDirs, dir)
+			}
+		}
+		report(iteration)
+	}
+	return nil
+}
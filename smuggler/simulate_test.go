@@ -0,0 +1,131 @@
+package smuggler_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+// Resource returning the given versions on each check
+type scriptedResource struct {
+	checks  [][]Version
+	checked []Version
+}
+
+func (r *scriptedResource) Check(ctx context.Context, request *ResourceRequest) ([]Version, error) {
+	r.checked = append(r.checked, request.Version)
+	versions := r.checks[0]
+	r.checks = r.checks[1:]
+	return versions, nil
+}
+
+func (r *scriptedResource) In(ctx context.Context, dir string, request *ResourceRequest) (*ResourceResponse, error) {
+	err := ioutil.WriteFile(filepath.Join(dir, "version"), []byte(request.Version["ID"]), 0644)
+	return &ResourceResponse{Version: request.Version}, err
+}
+
+func (r *scriptedResource) Out(ctx context.Context, dir string, request *ResourceRequest) (*ResourceResponse, error) {
+	return nil, nil
+}
+
+var _ = Describe("VersionHistory", func() {
+	var history *VersionHistory
+	BeforeEach(func() {
+		history = &VersionHistory{Versions: []Version{{"ID": "1"}, {"ID": "2"}}}
+	})
+
+	It("appends the new versions only", func() {
+		added, regressions := history.Add(Version{"ID": "2"}, []Version{{"ID": "2"}, {"ID": "3"}, {"ID": "3"}})
+		Ω(added).Should(Equal([]Version{{"ID": "3"}}))
+		Ω(regressions).Should(BeEmpty())
+		Ω(history.Versions).Should(Equal([]Version{{"ID": "1"}, {"ID": "2"}, {"ID": "3"}}))
+		Ω(history.Latest()).Should(Equal(Version{"ID": "3"}))
+	})
+
+	It("reports when check loses the current version", func() {
+		added, regressions := history.Add(Version{"ID": "2"}, []Version{{"ID": "3"}})
+		Ω(added).Should(Equal([]Version{{"ID": "3"}}))
+		Ω(regressions).Should(Equal([]string{`check did not return the current version {"ID":"2"}`}))
+	})
+
+	It("reports when check goes backwards", func() {
+		_, regressions := history.Add(Version{"ID": "2"}, []Version{{"ID": "2"}, {"ID": "1"}})
+		Ω(regressions).Should(ConsistOf(ContainSubstring(`check went backwards: returned {"ID":"1"} as newest`)))
+		Ω(history.Latest()).Should(Equal(Version{"ID": "2"}))
+	})
+
+	It("is saved and loaded as JSON", func() {
+		f, err := ioutil.TempFile("", "history")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Remove(f.Name())
+
+		Ω(history.Save(f.Name())).Should(Succeed())
+		loaded, err := LoadVersionHistory(f.Name())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(loaded).Should(Equal(history))
+
+		loaded, err = LoadVersionHistory(f.Name() + ".missing")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(loaded.Versions).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("Simulation", func() {
+	var (
+		resource   *scriptedResource
+		simulation *Simulation
+		iterations []*SimulationIteration
+		dataDir    string
+	)
+	BeforeEach(func() {
+		dataDir, err = ioutil.TempDir("", "smuggler-simulate")
+		Ω(err).ShouldNot(HaveOccurred())
+		resource = &scriptedResource{checks: [][]Version{
+			{{"ID": "1"}},
+			{{"ID": "1"}, {"ID": "2"}, {"ID": "3"}},
+			{{"ID": "2"}},
+		}}
+		simulation = &Simulation{
+			Resource: resource,
+			Request: func(requestType RequestType, version Version) (*ResourceRequest, error) {
+				return &ResourceRequest{Type: requestType, Version: version}, nil
+			},
+			History: &VersionHistory{},
+			InDir:   dataDir,
+		}
+		iterations = nil
+	})
+	JustBeforeEach(func() {
+		err = simulation.Run(context.Background(), 3, func(i *SimulationIteration) {
+			iterations = append(iterations, i)
+		})
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	It("feeds back the newest version to check", func() {
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resource.checked).Should(Equal([]Version{nil, {"ID": "1"}, {"ID": "3"}}))
+		Ω(iterations[1].New).Should(Equal([]Version{{"ID": "2"}, {"ID": "3"}}))
+	})
+
+	It("runs in for the new versions in their own directories", func() {
+		Ω(iterations[1].InDirs).Should(Equal([]string{filepath.Join(dataDir, "2"), filepath.Join(dataDir, "3")}))
+		content, err := ioutil.ReadFile(filepath.Join(dataDir, "3", "version"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(content)).Should(Equal("3"))
+	})
+
+	It("reports the regressions", func() {
+		Ω(iterations[0].Regressions).Should(BeEmpty())
+		Ω(iterations[1].Regressions).Should(BeEmpty())
+		Ω(iterations[2].Regressions).Should(HaveLen(2))
+	})
+})
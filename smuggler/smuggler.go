@@ -11,13 +11,34 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 )
 
+// File descriptor that commands can write the response to if `response_fd`
+// is set, as the first extra file passed to the command
+const ResponseFd = 3
+
+// Name of the file in the output dir that commands can write the response
+// to if `response_fd` is set
+const ResponseFileName = "response.json"
+
+// File in the output dir that backs the response file descriptor
+const responseFdFileName = ".response_fd"
+
 type SmugglerCommand struct {
-	lastCommand       *exec.Cmd
-	logger            *log.Logger
-	LastCommandOutput []byte
-	LastCommandErr    []byte
+	lastCommand         *exec.Cmd
+	logger              *log.Logger
+	extraFiles          []*os.File
+	envNaming           EnvNaming
+	sensitiveValues     []string
+	ranBuiltin          bool
+	builtinExitStatus   int
+	LastCommandOutput   []byte
+	LastCommandErr      []byte
+	LastCommandDuration time.Duration
+	// Explain what would run instead of running it, as `smuggler_dry_run`
+	DryRun      bool
+	Explanation *Explanation
 }
 
 func NewSmugglerCommand(logger *log.Logger) *SmugglerCommand {
@@ -29,37 +50,60 @@ func (command *SmugglerCommand) LastCommand() *exec.Cmd {
 }
 
 func (command *SmugglerCommand) LastCommandSuccess() bool {
-	if command.lastCommand == nil || command.lastCommand.ProcessState == nil {
-		return true
-	}
-	return command.lastCommand.ProcessState.Success()
+	return command.LastCommandExitStatus() == 0
 }
 
 func (command *SmugglerCommand) LastCommandExitStatus() int {
+	if command.ranBuiltin {
+		return command.builtinExitStatus
+	}
+	if command.lastCommand == nil || command.lastCommand.ProcessState == nil {
+		return 0
+	}
 	waitStatus := command.lastCommand.ProcessState.Sys().(syscall.WaitStatus)
 	return waitStatus.ExitStatus()
 }
 
+// Replace the sensitive values, like the ones from resolvers, to print them
+func (command *SmugglerCommand) Redact(b []byte) []byte {
+	for _, v := range command.sensitiveValues {
+		b = bytes.Replace(b, []byte(v), []byte("((redacted))"), -1)
+	}
+	return b
+}
+
 func (command *SmugglerCommand) Run(commandDefinition CommandDefinition, params map[string]interface{}, jsonRequest []byte) error {
 
 	path := commandDefinition.Path
-	args := commandDefinition.Args
 
-	params_env := make([]string, 0, len(params))
-	for k, v := range params {
-		string_val := InterfaceToJsonString(v)
-		env_key_val := fmt.Sprintf("SMUGGLER_%s=%s", k, string_val)
-		params_env = append(params_env, env_key_val)
+	params_env, err := command.envNaming.Env(params)
+	if err != nil {
+		return err
 	}
 	params_env = append(params_env, os.Environ()...)
 
+	if commandDefinition.Builtin != "" {
+		return command.runBuiltin(commandDefinition, params, params_env, jsonRequest)
+	}
+	if commandDefinition.Starlark != "" {
+		return command.runStarlark(commandDefinition, params, params_env, jsonRequest)
+	}
+
+	args, cleanup, err := commandDefinition.prepareArgs()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
 	command.logger.Printf(
 		"[INFO] Running command:\n\tPath: '%s'\n\tArgs: '%s'\n\tEnv:\n\t'%s'",
-		path, strings.Join(args, "' '"), strings.Join(params_env, "',\n\t'"),
+		path, strings.Join(args, "' '"), command.Redact([]byte(strings.Join(params_env, "',\n\t'"))),
 	)
 
+	command.ranBuiltin = false
 	command.lastCommand = exec.Command(path, args...)
 	command.lastCommand.Env = params_env
+	command.lastCommand.ExtraFiles = command.extraFiles
 
 	command.lastCommand.Stdin = bytes.NewBuffer(jsonRequest)
 	stdout := new(bytes.Buffer)
@@ -67,11 +111,63 @@ func (command *SmugglerCommand) Run(commandDefinition CommandDefinition, params
 	stderr := new(bytes.Buffer)
 	command.lastCommand.Stderr = stderr
 
-	err := command.lastCommand.Run()
+	start := time.Now()
+	err = command.lastCommand.Run()
+	command.LastCommandDuration = time.Since(start)
 	command.LastCommandOutput, _ = ioutil.ReadAll(stdout)
 	command.LastCommandErr, _ = ioutil.ReadAll(stderr)
-	command.logger.Printf("[INFO] Output '%s'", command.LastCommandOutput)
-	command.logger.Printf("[INFO] Stderr '%s'", command.LastCommandErr)
+	command.logger.Printf("[INFO] Output '%s'", command.Redact(command.LastCommandOutput))
+	command.logger.Printf("[INFO] Stderr '%s'", command.Redact(command.LastCommandErr))
+	command.logger.Printf("[INFO] Return error '%v'", err)
+
+	return err
+}
+
+func (command *SmugglerCommand) runBuiltin(commandDefinition CommandDefinition, params map[string]interface{}, env []string, jsonRequest []byte) error {
+	builtin, ok := FindBuiltin(commandDefinition.Builtin)
+	if !ok {
+		return fmt.Errorf("unknown builtin '%s'", commandDefinition.Builtin)
+	}
+	command.logger.Printf(
+		"[INFO] Running builtin '%s' with '%s'",
+		commandDefinition.Builtin, command.Redact([]byte(InterfaceToJsonString(commandDefinition.With))),
+	)
+	return command.runInProcess(fmt.Sprintf("builtin '%s'", commandDefinition.Builtin),
+		builtin.Run, commandDefinition.With, params, env, jsonRequest)
+}
+
+// Runs a builtin or script inside the smuggler process, recording its
+// output and exit status as for external commands
+func (command *SmugglerCommand) runInProcess(description string, run func(*BuiltinContext) error, with map[string]interface{}, params map[string]interface{}, env []string, jsonRequest []byte) error {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	ctx := &BuiltinContext{
+		With:   with,
+		Params: params,
+		Env:    env,
+		Stdin:  bytes.NewBuffer(jsonRequest),
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+
+	start := time.Now()
+	command.lastCommand = nil
+	command.ranBuiltin = true
+	err := run(ctx)
+	command.builtinExitStatus = 0
+	if err != nil {
+		command.builtinExitStatus = 1
+		if exitErr, ok := err.(*ExitError); ok && exitErr.Status != 0 {
+			command.builtinExitStatus = exitErr.Status
+		}
+		fmt.Fprintf(stderr, "%s\n", err)
+		err = fmt.Errorf("%s failed: %s", description, err)
+	}
+	command.LastCommandDuration = time.Since(start)
+	command.LastCommandOutput = stdout.Bytes()
+	command.LastCommandErr = stderr.Bytes()
+	command.logger.Printf("[INFO] Output '%s'", command.Redact(command.LastCommandOutput))
+	command.logger.Printf("[INFO] Stderr '%s'", command.Redact(command.LastCommandErr))
 	command.logger.Printf("[INFO] Return error '%v'", err)
 
 	return err
@@ -84,54 +180,174 @@ func (command *SmugglerCommand) RunAction(dataDir string, request *ResourceReque
 		Type: request.Type,
 	}
 
+	err := request.Source.Validate()
+	if err != nil {
+		return &response, err
+	}
+
 	commandDefinition, err := request.Source.FindCommand(string(request.Type))
 	if err != nil {
 		return &response, err
 	}
 
+	dryRun := command.isDryRun(request)
+	if dryRun {
+		command.Explanation = &Explanation{Action: request.Type, ConfigFile: request.ConfigFile}
+		defer func() {
+			command.logger.Printf("[INFO] %s", command.Explanation)
+		}()
+	}
+
+	if commandDefinition == nil && request.Source.Composite != nil {
+		if dryRun {
+			command.Explanation.Composite = compositeNames(request.Source)
+			command.Explanation.Note = "Each sub-resource runs its own command"
+			return dryRunResponse(request), nil
+		}
+		return command.runComposite(dataDir, request)
+	}
+
+	wrap := request.Source.Wrap
+	wrapped := false
+	if commandDefinition == nil && wrap != nil {
+		commandDefinition, wrapped, err = wrap.FindCommand(request, dataDir)
+		if err != nil {
+			return &response, err
+		}
+		if commandDefinition == nil && request.Type == InType {
+			command.logger.Printf("[INFO] Default version of the wrapped resource, skipping")
+			if dryRun {
+				command.Explanation.Note = "Default version of the wrapped resource, nothing to run"
+			}
+			response.Version = request.Version
+			return &response, command.finishResponse(request, &response)
+		}
+	}
+
 	if commandDefinition == nil {
 		command.logger.Printf("[INFO] No command definition, skipping")
+		if dryRun {
+			command.Explanation.Note = "No command definition, nothing to run"
+		}
 		return &response, nil
 	}
 
+	if commandDefinition.Plugin != "" {
+		if err := validatePluginAction(commandDefinition, request.Type); err != nil {
+			return &response, err
+		}
+	}
+
 	outputDir, err := ioutil.TempDir("", "smuggler-run")
 	if err != nil {
 		return &response, err
 	}
 	defer os.RemoveAll(outputDir)
 
+	// The params file is in the build and resolvers run commands, so a
+	// dry run passes the params unresolved
+	if dryRun {
+		command.Explanation.ParamsFile = request.Params.SmugglerParamsFile
+	} else {
+		sensitive, err := resolveRequest(request)
+		if err != nil {
+			return &response, err
+		}
+		command.sensitiveValues = append(command.sensitiveValues, sensitive...)
+
+		// The file is written by the build, so its values are not resolved:
+		// a `((cmd:...))` in it would run in the resource container
+		err = loadParamsFile(dataDir, request)
+		if err != nil {
+			return &response, err
+		}
+	}
+
+	err = writeRequestFiles(outputDir, request)
+	if err != nil {
+		return &response, err
+	}
+
+	command.envNaming = request.Source.EnvNaming()
 	params, err := prepareParams(dataDir, outputDir, request)
 	if err != nil {
 		return &response, err
 	}
 
-	jsonRequest, err := prepareJsonRequest(request)
+	var stdinRequest []byte
+	if wrapped {
+		stdinRequest, err = wrap.prepareJsonRequest(request)
+	} else if commandDefinition.Plugin != "" {
+		stdinRequest, err = preparePluginRequest(commandDefinition, dataDir, outputDir, request)
+	} else if commandDefinition.Starlark != "" {
+		// Scripts get the request as a dict, whatever the request_format
+		stdinRequest, err = prepareJsonRequest(request)
+	} else {
+		stdinRequest, err = prepareStdinRequest(request, params)
+	}
 	if err != nil {
 		return &response, err
 	}
 
-	err = command.Run(*commandDefinition, params, jsonRequest)
+	if dryRun {
+		err = command.Explanation.explain(commandDefinition, wrapped, params, stdinRequest,
+			builtinParams(dataDir, outputDir, request), request)
+		if err != nil {
+			return &response, err
+		}
+		return dryRunResponse(request), nil
+	}
+
+	// Wrapped resources always write the response to stdout
+	responseFd := request.Source.ResponseFd && !wrapped
+	command.extraFiles = nil
+	if responseFd {
+		responseFd, err := os.OpenFile(
+			filepath.Join(outputDir, responseFdFileName),
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600,
+		)
+		if err != nil {
+			return &response, err
+		}
+		defer responseFd.Close()
+		command.extraFiles = []*os.File{responseFd}
+	}
+
+	err = command.Run(*commandDefinition, params, stdinRequest)
 	if err != nil {
 		return &response, err
 	}
 
-	// Try to get the response from a valid json from Stdout.
-	// If not, as files from the output directory
-	err = populateResponseFromStdoutAsJson(command.LastCommandOutput, request, &response)
+	err = command.populateResponse(outputDir, request, responseFd, &response)
 	if err != nil {
-		err = populateResponseFromOutputDir(outputDir, request, &response)
+		return &response, err
+	}
+
+	if wrapped {
+		err = wrap.transformResponse(&response)
 		if err != nil {
 			return &response, err
 		}
-	} else {
-		// Empty the output buffer
-		command.LastCommandOutput = []byte{}
+	}
+
+	return &response, command.finishResponse(request, &response)
+}
+
+// Validates the response of the action and appends the auto metadata
+func (command *SmugglerCommand) finishResponse(request *ResourceRequest, response *ResourceResponse) error {
+	err := validateResponse(response, request.Source.EnvNaming())
+	if err != nil {
+		return err
+	}
+
+	if request.Type != CheckType {
+		appendAutoMetadata(command, request.Source, response)
 	}
 
 	command.logger.Printf("[INFO] command reports versions '%q'", response.Versions)
 	command.logger.Printf("[INFO] command reports metadata '%q'", response.Metadata)
 
-	return &response, nil
+	return nil
 }
 
 func copyMaps(maps ...map[string]interface{}) map[string]interface{} {
@@ -156,14 +372,60 @@ func prepareParams(dataDir string, outputDir string, request *ResourceRequest) (
 		request.Params.SmugglerParams,
 		request.Params.ExtraParams,
 	)
+	var err error
+	if request.Source.FlattenParams {
+		params, err = flattenParams(params, request.Source.FlattenSeparator)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// It would be the variable of the prefix and the params dir itself
+	if _, ok := params[""]; ok {
+		return nil, fmt.Errorf("params can not have an empty name")
+	}
+
+	err = writeParamsFiles(outputDir, params, request.Source)
+	if err != nil {
+		return nil, err
+	}
+	params = selectEnvParams(params, request.Source.ParamsAsEnv)
+
+	for k, v := range builtinParams(dataDir, outputDir, request) {
+		params[k] = v
+	}
+
+	// Let the commands discover the variable of each param
+	names, err := request.Source.EnvNaming().VarNames(params)
+	if err != nil {
+		return nil, err
+	}
+	params["PARAM_NAMES"] = names
+
+	return params, nil
+}
+
+// The params set by smuggler itself, which override the ones of the user
+func builtinParams(dataDir string, outputDir string, request *ResourceRequest) map[string]interface{} {
+	params := make(map[string]interface{})
+	params["PARAMS_DIR"] = filepath.Join(outputDir, ParamsDirName)
+	params["PARAMS_FILE"] = filepath.Join(outputDir, ParamsFileName)
 	params["ACTION"] = string(request.Type)
 	params["COMMAND"] = string(request.Type)
 	params["OUTPUT_DIR"] = outputDir
+	params["REQUEST_FILE"] = filepath.Join(outputDir, RequestFileName)
+	params["FILTERED_REQUEST_FILE"] = filepath.Join(outputDir, FilteredRequestFileName)
+	if request.Source.ResponseFd {
+		params["RESPONSE_FD"] = ResponseFd
+		params["RESPONSE_FILE"] = filepath.Join(outputDir, ResponseFileName)
+	}
 	switch request.Type {
 	case "check", "in":
 		for k, v := range request.Version {
 			params[fmt.Sprintf("VERSION_%s", k)] = v
 		}
+		if request.Version != nil {
+			params["VERSION_JSON"] = InterfaceToJsonString(request.Version)
+		}
 	}
 	switch request.Type {
 	case "in":
@@ -171,8 +433,7 @@ func prepareParams(dataDir string, outputDir string, request *ResourceRequest) (
 	case "out":
 		params["SOURCES_DIR"] = dataDir
 	}
-
-	return params, nil
+	return params
 }
 
 func prepareJsonRequest(request *ResourceRequest) ([]byte, error) {
@@ -186,6 +447,101 @@ func prepareJsonRequest(request *ResourceRequest) ([]byte, error) {
 	return jsonRequest, err
 }
 
+//
+// Populates the response from the JSON response channel and/or the output
+// directory, depending on `response_mode`. The JSON response channel is
+// stdout, or the response file descriptor if responseFd is set.
+//
+func (command *SmugglerCommand) populateResponse(outputDir string, request *ResourceRequest, responseFd bool, response *ResourceResponse) error {
+	jsonResponse, channel, err := command.readJsonResponse(outputDir, responseFd)
+	if err != nil {
+		return err
+	}
+	// Only stdout can contain something else than the response
+	strictJson := channel != "stdout" && len(bytes.TrimSpace(jsonResponse)) > 0
+
+	switch request.Source.ResponseMode {
+	case ResponseModeStdout:
+		err := populateResponseFromStdoutAsJson(jsonResponse, request, response)
+		if err != nil {
+			return fmt.Errorf(
+				"response_mode is '%s' but the command did not write a valid JSON response to %s: %s",
+				ResponseModeStdout, channel, err,
+			)
+		}
+		command.consumeJsonResponse(channel)
+	case ResponseModeFiles:
+		return populateResponseFromOutputDir(outputDir, request, response)
+	case ResponseModeMerged:
+		jsonChannelResponse := ResourceResponse{Type: response.Type}
+		jsonErr := populateResponseFromStdoutAsJson(jsonResponse, request, &jsonChannelResponse)
+		if jsonErr != nil && strictJson {
+			return fmt.Errorf("invalid JSON response in %s: %s", channel, jsonErr)
+		}
+		err := populateResponseFromOutputDir(outputDir, request, response)
+		if err != nil {
+			return err
+		}
+		if jsonErr == nil {
+			command.consumeJsonResponse(channel)
+			mergeResponses(response, &jsonChannelResponse)
+		}
+	default:
+		// Try to get the response from a valid json from the response channel.
+		// If not, as files from the output directory
+		err := populateResponseFromStdoutAsJson(jsonResponse, request, response)
+		if err != nil {
+			if strictJson {
+				return fmt.Errorf("invalid JSON response in %s: %s", channel, err)
+			}
+			return populateResponseFromOutputDir(outputDir, request, response)
+		}
+		command.consumeJsonResponse(channel)
+	}
+	return nil
+}
+
+// Returns the content of the JSON response channel and a description of it
+func (command *SmugglerCommand) readJsonResponse(outputDir string, responseFd bool) ([]byte, string, error) {
+	if !responseFd {
+		return command.LastCommandOutput, "stdout", nil
+	}
+
+	fdChannel := fmt.Sprintf("fd %d", ResponseFd)
+	channels := map[string]string{
+		responseFdFileName: fdChannel,
+		ResponseFileName:   fmt.Sprintf("${%s}/%s", command.envNaming.VarName("OUTPUT_DIR"), ResponseFileName),
+	}
+	for _, f := range []string{responseFdFileName, ResponseFileName} {
+		content, err := ioutil.ReadFile(filepath.Join(outputDir, f))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, "", err
+		}
+		if len(bytes.TrimSpace(content)) > 0 {
+			return content, channels[f], nil
+		}
+	}
+	return []byte{}, fdChannel, nil
+}
+
+// Once stdout is used as response, it is not command output anymore
+func (command *SmugglerCommand) consumeJsonResponse(channel string) {
+	if channel == "stdout" {
+		// Empty the output buffer
+		command.LastCommandOutput = []byte{}
+	}
+}
+
+// Merges the response from stdout into the one read from the output dir.
+// The version in stdout has priority, versions and metadata are combined.
+func mergeResponses(response *ResourceResponse, stdoutResponse *ResourceResponse) {
+	if len(stdoutResponse.Version) > 0 {
+		response.Version = stdoutResponse.Version
+	}
+	response.Versions = append(stdoutResponse.Versions, response.Versions...)
+	response.Metadata = append(stdoutResponse.Metadata, response.Metadata...)
+}
+
 //
 // Tries to populate the response from the stdout
 //
@@ -392,6 +392,1403 @@ var _ = Describe("SmugglerCommand named versions", func() {
 	})
 })
 
+var _ = Describe("SmugglerCommand auto metadata", func() {
+	BeforeEach(func() {
+		dataDir = "/some/path"
+	})
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, dataDir, fixtureResourceName, "1.2.3")
+	})
+
+	Context("when auto_metadata is set", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "auto_metadata"
+		})
+		for _, t := range []RequestType{InType, OutType} {
+			t := t
+			Context("when calling action '"+string(t)+"'", func() {
+				BeforeEach(func() {
+					requestType = t
+				})
+				It("appends the requested metadata to the response", func() {
+					Ω(err).ShouldNot(HaveOccurred())
+					names := []string{}
+					for _, m := range response.Metadata {
+						names = append(names, m.Name)
+					}
+					Ω(names).Should(Equal([]string{"hostname", "duration", "smuggler_version"}))
+					Ω(response.Metadata).Should(ContainElement(MetadataPair{Name: "smuggler_version", Value: SmugglerVersion}))
+				})
+				It("keeps the metadata reported by the command", func() {
+					Ω(response.Metadata[0]).Should(Equal(MetadataPair{Name: "hostname", Value: "from_script"}))
+				})
+			})
+		}
+	})
+
+	Context("when auto_metadata_on_conflict is replace", func() {
+		BeforeEach(func() {
+			requestType = InType
+			fixtureResourceName = "auto_metadata_replace"
+		})
+		It("overrides the metadata reported by the command", func() {
+			hostname, _ := os.Hostname()
+			Ω(response.Metadata).Should(Equal([]MetadataPair{{Name: "hostname", Value: hostname}}))
+		})
+	})
+
+	Context("when auto_metadata has an unknown entry", func() {
+		BeforeEach(func() {
+			requestType = InType
+			fixtureResourceName = "auto_metadata_invalid"
+		})
+		It("returns an error without running the command", func() {
+			Ω(err).Should(MatchError(ContainSubstring("unknown auto_metadata 'not_a_metadata'")))
+			Ω(command.LastCommand()).Should(BeNil())
+		})
+	})
+
+	Context("when auto_metadata has exit_code", func() {
+		BeforeEach(func() {
+			requestType = InType
+			fixtureResourceName = "auto_metadata_unsupported"
+		})
+		It("returns an error explaining why it is not supported", func() {
+			Ω(err).Should(MatchError("auto_metadata 'exit_code' is not supported: it would always be 0, the metadata is only reported when the command succeeds"))
+			Ω(command.LastCommand()).Should(BeNil())
+		})
+	})
+
+	Context("when building the build_url", func() {
+		var origEnv map[string]string
+		BeforeEach(func() {
+			origEnv = map[string]string{}
+			for _, k := range []string{"ATC_EXTERNAL_URL", "BUILD_TEAM_NAME", "BUILD_PIPELINE_NAME", "BUILD_JOB_NAME", "BUILD_NAME", "BUILD_ID"} {
+				origEnv[k] = os.Getenv(k)
+				os.Unsetenv(k)
+			}
+		})
+		AfterEach(func() {
+			for k, v := range origEnv {
+				os.Setenv(k, v)
+			}
+		})
+		It("uses the job build url if the job is known", func() {
+			os.Setenv("ATC_EXTERNAL_URL", "https://ci.example.com/")
+			os.Setenv("BUILD_TEAM_NAME", "main")
+			os.Setenv("BUILD_PIPELINE_NAME", "a_pipeline")
+			os.Setenv("BUILD_JOB_NAME", "a_job")
+			os.Setenv("BUILD_NAME", "42")
+			Ω(BuildUrlFromEnv()).Should(Equal("https://ci.example.com/teams/main/pipelines/a_pipeline/jobs/a_job/builds/42"))
+		})
+		It("falls back to the build id", func() {
+			os.Setenv("ATC_EXTERNAL_URL", "https://ci.example.com")
+			os.Setenv("BUILD_ID", "1234")
+			Ω(BuildUrlFromEnv()).Should(Equal("https://ci.example.com/builds/1234"))
+		})
+		It("is empty outside of concourse", func() {
+			Ω(BuildUrlFromEnv()).Should(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand response modes and validation", func() {
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, "/some/path", fixtureResourceName, "1.2.3")
+	})
+
+	Context("when response_mode is files", func() {
+		BeforeEach(func() {
+			requestType = InType
+			fixtureResourceName = "response_mode_files"
+		})
+		It("ignores the json in stdout and reads the output dir", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Version).Should(Equal(*NewVersion("from_files")))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("from_stdout"))
+		})
+	})
+
+	Context("when response_mode is stdout", func() {
+		BeforeEach(func() {
+			requestType = InType
+			fixtureResourceName = "response_mode_stdout"
+		})
+		It("fails if stdout is not a valid json response", func() {
+			Ω(err).Should(MatchError(ContainSubstring("did not write a valid JSON response to stdout")))
+		})
+	})
+
+	Context("when response_mode is merged", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "response_mode_merged"
+		})
+		Context("when calling action 'check'", func() {
+			BeforeEach(func() {
+				requestType = CheckType
+			})
+			It("combines the versions from stdout and the output dir", func() {
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Versions).Should(Equal(NewVersions([]string{"from_stdout", "from_files"})))
+				Ω(command.LastCommandOutput).Should(BeEmpty())
+			})
+		})
+		Context("when calling action 'in'", func() {
+			BeforeEach(func() {
+				requestType = InType
+			})
+			It("combines the version and metadata from stdout and the output dir", func() {
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Version).Should(Equal(*NewVersion("from_files")))
+				Ω(response.Metadata).Should(Equal([]MetadataPair{
+					{Name: "from", Value: "stdout"},
+					{Name: "from", Value: "files"},
+				}))
+			})
+		})
+	})
+
+	Context("when response_mode is not valid", func() {
+		BeforeEach(func() {
+			requestType = CheckType
+			fixtureResourceName = "response_mode_invalid"
+		})
+		It("returns an error without running the command", func() {
+			Ω(err).Should(MatchError(ContainSubstring("invalid response_mode 'telepathy'")))
+			Ω(command.LastCommand()).Should(BeNil())
+		})
+	})
+
+	Context("when the command returns an invalid response", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "invalid_responses"
+		})
+		Context("when check reports duplicated versions", func() {
+			BeforeEach(func() {
+				requestType = CheckType
+			})
+			It("returns an error", func() {
+				Ω(err).Should(MatchError(ContainSubstring(`check reported the version {"ID":"1.2.3"} twice (#1 and #3)`)))
+			})
+		})
+		Context("when in reports a version with an empty key", func() {
+			BeforeEach(func() {
+				requestType = InType
+			})
+			It("returns an error", func() {
+				Ω(err).Should(MatchError(ContainSubstring("has an empty key")))
+			})
+		})
+		Context("when out does not report a version", func() {
+			BeforeEach(func() {
+				requestType = OutType
+			})
+			It("returns an error", func() {
+				Ω(err).Should(MatchError(ContainSubstring("out did not report any version")))
+			})
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand response file descriptor", func() {
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, "/some/path", "response_fd", "1.2.3")
+	})
+
+	Context("when the command writes the response to the file descriptor", func() {
+		BeforeEach(func() {
+			requestType = CheckType
+		})
+		It("reads the response from the file descriptor", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Versions).Should(Equal(NewVersions([]string{"from_fd"})))
+		})
+		It("keeps stdout as command output", func() {
+			Ω(command.LastCommandOutput).Should(ContainSubstring("from_stdout"))
+		})
+	})
+
+	Context("when the command writes the response to the response file", func() {
+		BeforeEach(func() {
+			requestType = InType
+		})
+		It("reads the response from the file", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Version).Should(Equal(*NewVersion("from_file")))
+		})
+	})
+
+	Context("when the command prints json to stdout but no response", func() {
+		BeforeEach(func() {
+			requestType = OutType
+		})
+		It("ignores stdout and reads the output dir", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Version).Should(Equal(*NewVersion("from_files")))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("[]"))
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand request files and formats", func() {
+	var stdin []byte
+
+	BeforeEach(func() {
+		requestType = InType
+		dataDir, err = ioutil.TempDir("", "destination_dir")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, dataDir, fixtureResourceName, "1.2.3")
+		if requestType == InType {
+			Ω(err).ShouldNot(HaveOccurred())
+			stdin, err = ioutil.ReadFile(filepath.Join(dataDir, "stdin"))
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	Context("when the command reads the request files", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "request_files"
+		})
+		It("finds the raw request in SMUGGLER_REQUEST_FILE", func() {
+			b, err := ioutil.ReadFile(filepath.Join(dataDir, "request.json"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(b).Should(MatchJSON(requestJson))
+		})
+		It("finds the filtered request in SMUGGLER_FILTERED_REQUEST_FILE", func() {
+			b, err := ioutil.ReadFile(filepath.Join(dataDir, "filtered_request.json"))
+			Ω(err).ShouldNot(HaveOccurred())
+			b_filtered, err := json.Marshal(&request.FilteredRequest)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(b).Should(MatchJSON(b_filtered))
+			Ω(stdin).Should(MatchJSON(b_filtered))
+		})
+		Context("when calling action 'check'", func() {
+			BeforeEach(func() {
+				requestType = CheckType
+			})
+			It("gets the version as json in SMUGGLER_VERSION_JSON", func() {
+				Ω(command.LastCommandOutput).Should(ContainSubstring(`version_json={"ID":"1.2.3"}`))
+			})
+		})
+	})
+
+	Context("when request_format is yaml", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "request_format_yaml"
+		})
+		It("sends the request as yaml via stdin", func() {
+			Ω(string(stdin)).Should(ContainSubstring("version:\n  ID: 1.2.3\n"))
+			Ω(string(stdin)).Should(ContainSubstring("request_format: yaml\n"))
+		})
+	})
+
+	Context("when request_format is env-file", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "request_format_env_file"
+		})
+		It("sends the params as quoted variables via stdin", func() {
+			Ω(string(stdin)).Should(ContainSubstring("SMUGGLER_VERSION_ID='1.2.3'\n"))
+			Ω(string(stdin)).Should(ContainSubstring(`SMUGGLER_a_source_param='it'\''s a value'` + "\n"))
+		})
+	})
+
+	Context("when request_format is none", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "request_format_none"
+		})
+		It("sends nothing via stdin", func() {
+			Ω(stdin).Should(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand flattened params", func() {
+	JustBeforeEach(func() {
+		runCommandFromFixture(InType, "/some/path", fixtureResourceName, "1.2.3")
+	})
+
+	Context("when flatten_params is set", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "flatten_params"
+		})
+		It("exports nested maps and lists as separate variables", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command.LastCommandOutput).Should(ContainSubstring("aws_region=eu-west-1\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("aws_buckets_1_name=second\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("aws_buckets_COUNT=2\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("tags_0=a\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("tags_COUNT=2\n"))
+		})
+		It("keeps the json version of the params", func() {
+			Ω(command.LastCommandOutput).Should(ContainSubstring(`tags=["a","b"]`))
+		})
+	})
+
+	Context("when flatten_separator is set", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "flatten_params_separator"
+		})
+		It("uses the separator", func() {
+			Ω(command.LastCommandOutput).Should(ContainSubstring("aws__region=eu-west-1\n"))
+		})
+	})
+
+	Context("when a flattened param collides with other param", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "flatten_params_collision"
+		})
+		It("returns an error without running the command", func() {
+			Ω(err).Should(MatchError("flattened param 'aws_region' from 'aws' collides with the param 'aws_region'"))
+			Ω(command.LastCommand()).Should(BeNil())
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand environment variable names", func() {
+	BeforeEach(func() {
+		requestType = InType
+	})
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, "/some/path", fixtureResourceName, "1.2.3")
+	})
+
+	Context("when params have characters not valid in variable names", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "env_naming"
+		})
+		It("replaces them with '_'", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command.LastCommandOutput).Should(ContainSubstring("docker_repo=a_repo\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("aws_region=eu-west-1\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("version_id=1.2.3\n"))
+		})
+		It("exports the mapping of param names to variables", func() {
+			var names map[string]string
+			for _, l := range strings.Split(string(command.LastCommandOutput), "\n") {
+				if strings.HasPrefix(l, "param_names=") {
+					err := json.Unmarshal([]byte(strings.TrimPrefix(l, "param_names=")), &names)
+					Ω(err).ShouldNot(HaveOccurred())
+				}
+			}
+			Ω(names).Should(HaveKeyWithValue("docker-repo", "SMUGGLER_docker_repo"))
+			Ω(names).Should(HaveKeyWithValue("aws.region", "SMUGGLER_aws_region"))
+			Ω(names).Should(HaveKeyWithValue("VERSION_ID", "SMUGGLER_VERSION_ID"))
+		})
+	})
+
+	Context("when env_prefix, env_uppercase and env_replacement are set", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "env_naming_custom"
+		})
+		It("uses them to name the variables", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command.LastCommandOutput).Should(ContainSubstring("docker_repo=a_repo\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("action=in\n"))
+		})
+	})
+
+	Context("when env_prefix is set and the response is invalid", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "env_naming_custom_out"
+			requestType = OutType
+		})
+		It("names the variables with the prefix in the error", func() {
+			Ω(err).Should(MatchError(ContainSubstring("write it to ${MY_OUTPUT_DIR}/versions")))
+		})
+	})
+
+	Context("when a param has an empty name", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "env_naming_empty_key"
+		})
+		It("returns an error without running the command", func() {
+			Ω(err).Should(MatchError("params can not have an empty name"))
+			Ω(command.LastCommand()).Should(BeNil())
+		})
+	})
+
+	Context("when a param in smuggler_params has an empty name", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "env_naming_empty_smuggler_params_key"
+		})
+		It("returns an error without running the command", func() {
+			Ω(err).Should(MatchError("params can not have an empty name"))
+			Ω(command.LastCommand()).Should(BeNil())
+		})
+	})
+
+	Context("when two params have the same variable name", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "env_naming_collision"
+		})
+		It("returns an error without running the command", func() {
+			Ω(err).Should(MatchError(ContainSubstring(
+				"params 'docker-repo' and 'docker_repo' are both passed as the environment variable 'SMUGGLER_docker_repo'",
+			)))
+			Ω(command.LastCommand()).Should(BeNil())
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand params as files", func() {
+	BeforeEach(func() {
+		dataDir, err = ioutil.TempDir("", "destination_dir")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	JustBeforeEach(func() {
+		runCommandFromFixture(InType, dataDir, fixtureResourceName, "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	Context("when the command reads the params dir and file", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "params_as_files"
+		})
+		It("writes each param in a file", func() {
+			b, err := ioutil.ReadFile(filepath.Join(dataDir, "params", "multi_line"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(b)).Should(Equal("line 1\nline 2\n"))
+
+			b, err = ioutil.ReadFile(filepath.Join(dataDir, "params", "complex_param"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(b).Should(MatchJSON(`{"with": "keys"}`))
+		})
+		It("decodes the base64 params", func() {
+			b, err := ioutil.ReadFile(filepath.Join(dataDir, "params", "id_rsa"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(b)).Should(Equal("secret key\n"))
+		})
+		It("writes all the params as json", func() {
+			b, err := ioutil.ReadFile(filepath.Join(dataDir, "params.json"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(b).Should(MatchJSON(`{
+				"multi-line": "line 1\nline 2\n",
+				"complex_param": {"with": "keys"},
+				"id_rsa_b64": "c2VjcmV0IGtleQo="
+			}`))
+		})
+	})
+
+	Context("when params_as_env is false", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "params_as_env_false"
+		})
+		It("does not pass the params as environment variables", func() {
+			Ω(command.LastCommandOutput).Should(ContainSubstring("secret=undef\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("secret_file=a_secret\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("action=in\n"))
+		})
+	})
+
+	Context("when params_as_env is a list", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "params_as_env_list"
+		})
+		It("only passes those params as environment variables", func() {
+			Ω(command.LastCommandOutput).Should(ContainSubstring("secret=undef\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("not_secret=not_a_secret\n"))
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand params file", func() {
+	BeforeEach(func() {
+		dataDir, err = ioutil.TempDir("", "sources_dir")
+		Ω(err).ShouldNot(HaveOccurred())
+		err = os.Mkdir(filepath.Join(dataDir, "some-input"), 0700)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = ioutil.WriteFile(
+			filepath.Join(dataDir, "some-input", "params.yml"),
+			[]byte("param1: from_file\nparam2: from_file\nparam3: [ 1, 2 ]\nparam4: ((cmd:echo injected))\n"),
+			0600,
+		)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, dataDir, "params_file", "1.2.3")
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	Context("when calling action 'out' with smuggler_params_file", func() {
+		BeforeEach(func() {
+			requestType = OutType
+		})
+		It("passes the params from the file", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command.LastCommandOutput).Should(ContainSubstring("param2=from_file\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("param3=[1,2]\n"))
+		})
+		It("gives priority to the params in the step", func() {
+			Ω(command.LastCommandOutput).Should(ContainSubstring("param1=from_step\n"))
+		})
+		It("passes the params from the file in the request", func() {
+			Ω(command.LastCommandOutput).Should(MatchRegexp(`stdin=.*"param2":"from_file"`))
+			Ω(command.LastCommandOutput).Should(MatchRegexp(`stdin=.*"param1":"from_step"`))
+			Ω(command.LastCommandOutput).Should(MatchRegexp(`request_file=.*"param2":"from_file"`))
+			Ω(request.FilteredRequest.Params).Should(HaveKeyWithValue("param2", "from_file"))
+		})
+		It("passes the placeholders in the file as literal text", func() {
+			Ω(command.LastCommandOutput).Should(ContainSubstring("param4=((cmd:echo injected))\n"))
+		})
+		It("does not pass smuggler_params_file as a param", func() {
+			Ω(request.Params.ExtraParams).ShouldNot(HaveKey("smuggler_params_file"))
+		})
+	})
+
+	Context("when calling action 'in' with smuggler_params_file", func() {
+		BeforeEach(func() {
+			requestType = InType
+		})
+		It("returns an error", func() {
+			Ω(err).Should(MatchError(ContainSubstring("smuggler_params_file is only supported in 'put' steps")))
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand value resolvers", func() {
+	BeforeEach(func() {
+		os.Setenv("SMUGGLER_TEST_SECRET", "an env secret")
+	})
+	JustBeforeEach(func() {
+		runCommandFromFixture(InType, "/some/path", fixtureResourceName, "1.2.3")
+	})
+	AfterEach(func() {
+		os.Unsetenv("SMUGGLER_TEST_SECRET")
+	})
+
+	Context("when the params have placeholders", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "resolvers"
+		})
+		It("resolves them with the builtin resolvers", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command.LastCommandOutput).Should(ContainSubstring("from_file=a file secret\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("from_env=an env secret\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("from_cmd=a cmd secret\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("from_base64=a base64 secret\n"))
+			Ω(command.LastCommandOutput).Should(ContainSubstring(`nested={"list":["a base64 secret"]}`))
+		})
+		It("resolves them with the resolvers in the config", func() {
+			Ω(command.LastCommandOutput).Should(ContainSubstring("from_custom=a custom secret\n"))
+		})
+		It("resolves placeholders inside strings", func() {
+			Ω(command.LastCommandOutput).Should(ContainSubstring("interpolated=user:an env secret@host\n"))
+		})
+		It("resolves them in the raw request but not in the commands", func() {
+			Ω(command.LastCommandOutput).Should(ContainSubstring(`"from_env":"an env secret"`))
+			Ω(command.LastCommandOutput).Should(ContainSubstring(`"reverse":"echo \"$1\" | rev"`))
+		})
+		It("redacts the resolved values", func() {
+			Ω(command.Redact([]byte("the secret is an env secret"))).Should(Equal([]byte("the secret is ((redacted))")))
+		})
+	})
+
+	Context("when a placeholder uses an unknown resolver", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "resolvers_unknown"
+		})
+		It("returns an error without running the command", func() {
+			Ω(err).Should(MatchError("unknown resolver 'unknown' in '((unknown:something))'"))
+			Ω(command.LastCommand()).Should(BeNil())
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand encrypted values", func() {
+	JustBeforeEach(func() {
+		runCommandFromFixture(InType, "/some/path", "encrypted_values", "1.2.3")
+	})
+	AfterEach(func() {
+		os.Unsetenv(DecryptionKeyFileEnv)
+	})
+
+	Context("when the decryption key is available", func() {
+		BeforeEach(func() {
+			os.Setenv(DecryptionKeyFileEnv, "../fixtures/decryption.key")
+		})
+		It("decrypts the values", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command.LastCommandOutput).Should(ContainSubstring("secret=an encrypted secret\n"))
+		})
+		It("decrypts the values sealed with its public key", func() {
+			Ω(command.LastCommandOutput).Should(ContainSubstring("sealed=a sealed secret\n"))
+		})
+		It("redacts the decrypted values", func() {
+			Ω(command.Redact([]byte("an encrypted secret"))).Should(Equal([]byte("((redacted))")))
+		})
+	})
+
+	Context("when the decryption key is not available", func() {
+		It("returns an error without running the command", func() {
+			Ω(err).Should(MatchError(ContainSubstring("SMUGGLER_DECRYPTION_KEY_FILE is not set")))
+			Ω(command.LastCommand()).Should(BeNil())
+		})
+	})
+
+	Context("when encrypting and decrypting a value", func() {
+		It("returns the same value", func() {
+			key, err := ReadEncryptionKeyFile("../fixtures/decryption.key")
+			Ω(err).ShouldNot(HaveOccurred())
+			encrypted, err := EncryptValue(key, "some value")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(encrypted).Should(HavePrefix(EncryptedValuePrefix))
+			decrypted, err := DecryptValue(key, encrypted)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(decrypted).Should(Equal("some value"))
+		})
+		It("fails with a different key", func() {
+			key, err := ReadEncryptionKeyFile("../fixtures/decryption.key")
+			Ω(err).ShouldNot(HaveOccurred())
+			encrypted, err := EncryptValue(key, "some value")
+			Ω(err).ShouldNot(HaveOccurred())
+			key[0]++
+			_, err = DecryptValue(key, encrypted)
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("when sealing a value with the public key", func() {
+		var key, publicKey []byte
+		BeforeEach(func() {
+			key, err = ReadEncryptionKeyFile("../fixtures/decryption.key")
+			Ω(err).ShouldNot(HaveOccurred())
+			publicKey, err = PublicKey(key)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		It("can only be decrypted with the decryption key", func() {
+			sealed, err := SealValue(publicKey, "some value")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(sealed).Should(HavePrefix(SealedValuePrefix))
+			Ω(IsEncryptedValue(sealed)).Should(BeTrue())
+			decrypted, err := DecryptValue(key, sealed)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(decrypted).Should(Equal("some value"))
+
+			// The lowest bits of the first byte are ignored by X25519
+			key[1]++
+			_, err = DecryptValue(key, sealed)
+			Ω(err).Should(MatchError(ContainSubstring("is it encrypted with the right public key?")))
+		})
+		It("fails with an invalid public key", func() {
+			_, err := SealValue(publicKey[1:], "some value")
+			Ω(err).Should(MatchError(ContainSubstring("invalid public key")))
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand wrapping another resource", func() {
+	var version string
+	BeforeEach(func() {
+		version = "1.2.3"
+		dataDir, err = ioutil.TempDir("", "smuggler-wrap")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, dataDir, fixtureResourceName, version)
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	Context("when the request and response are transformed", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "wrap"
+		})
+		Context("on check", func() {
+			BeforeEach(func() {
+				requestType = CheckType
+			})
+			It("sends the transformed filtered request to the wrapped check", func() {
+				Ω(err).ShouldNot(HaveOccurred())
+				var sent RawResourceRequest
+				Ω(json.Unmarshal(command.LastCommandErr, &sent)).Should(Succeed())
+				Ω(sent.Source).Should(Equal(map[string]interface{}{
+					"bucket_name": "a_bucket",
+					"versioned":   true,
+				}))
+				Ω(sent.Params).Should(Equal(map[string]interface{}{"acl": "private"}))
+				Ω(sent.Version).Should(Equal(Version{"ID": "1.2.3"}))
+			})
+			It("maps the versions of the response", func() {
+				Ω(response.Versions).Should(Equal([]Version{{"ID": "abc"}, {"ID": "def"}}))
+			})
+		})
+		Context("on in", func() {
+			BeforeEach(func() {
+				requestType = InType
+			})
+			It("passes the destination dir to the wrapped in", func() {
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(command.LastCommand().Args).Should(Equal([]string{"../fixtures/wrapped/in", dataDir}))
+			})
+			It("transforms the response", func() {
+				Ω(response.Version).Should(Equal(Version{"ID": "abc"}))
+				Ω(response.Metadata).Should(BeEmpty())
+			})
+		})
+	})
+
+	Context("when the transformations are queries", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "wrap_query"
+			requestType = CheckType
+		})
+		It("sends the result of the query to the wrapped check", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command.LastCommandErr).Should(MatchJSON(`{"source": {"bucket_name": "a_bucket"}, "version": {"ID": "1.2.3"}}`))
+		})
+		It("applies the query to the list of versions", func() {
+			Ω(response.Versions).Should(Equal([]Version{{"ID": "def", "build": "2"}}))
+		})
+	})
+
+	Context("when the wrapped check returns no versions", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "wrap_default_version"
+			requestType = CheckType
+		})
+		It("returns the default_check_version", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Versions).Should(Equal([]Version{{"ID": "-"}}))
+		})
+	})
+
+	Context("when getting the default version", func() {
+		BeforeEach(func() {
+			requestType = InType
+			version = "-"
+		})
+		Context("without default_version_in", func() {
+			BeforeEach(func() {
+				fixtureResourceName = "wrap_default_version"
+			})
+			It("does not call the wrapped in and returns the version", func() {
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(command.LastCommand()).Should(BeNil())
+				Ω(response.Version).Should(Equal(Version{"ID": "-"}))
+			})
+			It("appends the auto metadata", func() {
+				Ω(response.Metadata).Should(Equal([]MetadataPair{{Name: "smuggler_version", Value: SmugglerVersion}}))
+			})
+		})
+		Context("with default_version_in", func() {
+			BeforeEach(func() {
+				fixtureResourceName = "wrap_default_version_in"
+			})
+			It("runs it instead of the wrapped in", func() {
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(filepath.Join(dataDir, "content")).Should(BeAnExistingFile())
+				Ω(response.Version).Should(Equal(Version{"ID": "-"}))
+			})
+		})
+	})
+
+	Context("when the action is defined in commands", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "wrap_overridden"
+			requestType = CheckType
+		})
+		It("runs the command instead of the wrapped one", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command.LastCommandOutput).Should(ContainSubstring("overridden check"))
+		})
+	})
+
+	Context("when response_fd is set", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "wrap_response_fd"
+			requestType = CheckType
+		})
+		It("reads the response of the wrapped resource from stdout", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Versions).Should(Equal([]Version{
+				{"ref": "abc", "build": "1"}, {"ref": "def", "build": "2"},
+			}))
+		})
+		It("does not pass the response file descriptor", func() {
+			Ω(command.LastCommand().ExtraFiles).Should(BeEmpty())
+		})
+	})
+
+	Context("when the path is missing", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "wrap_without_path"
+			requestType = CheckType
+		})
+		It("returns an error without running anything", func() {
+			Ω(err).Should(MatchError("wrap.path is required"))
+			Ω(command.LastCommand()).Should(BeNil())
+		})
+	})
+
+	Context("when a transform operation has several actions", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "wrap_invalid_transform"
+			requestType = CheckType
+		})
+		It("returns an error", func() {
+			Ω(err).Should(MatchError(ContainSubstring("each transform operation must have one of")))
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand composite resources", func() {
+	var version string
+	BeforeEach(func() {
+		fixtureResourceName = "composite"
+		version = `{"a.ID": "1.0", "b.ref": "abc"}`
+		dataDir, err = ioutil.TempDir("", "smuggler-composite")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, dataDir, fixtureResourceName, version)
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	Context("on check", func() {
+		BeforeEach(func() {
+			requestType = CheckType
+		})
+		It("returns the latest versions of the sub-resources as one version", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Versions).Should(Equal([]Version{{"a.ID": "1.1", "b.ref": "def"}}))
+		})
+		It("sends each sub-resource its source and version", func() {
+			Ω(command.LastCommandErr).Should(MatchJSON(`{"source": {"bucket": "a_bucket"}, "version": {"ref": "abc"}}`))
+		})
+	})
+
+	Context("on check when a sub-resource returns no versions", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "composite_no_new_versions"
+			requestType = CheckType
+		})
+		It("keeps its current version in the composite version", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Versions).Should(Equal([]Version{{"a.ID": "1.1", "b.ref": "abc"}}))
+		})
+	})
+
+	Context("on in", func() {
+		BeforeEach(func() {
+			requestType = InType
+		})
+		It("gets each sub-resource into its own directory", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(filepath.Join(dataDir, "a", "a.txt")).Should(BeAnExistingFile())
+			Ω(command.LastCommand().Args).Should(Equal([]string{"../fixtures/wrapped/in", filepath.Join(dataDir, "b")}))
+		})
+		It("returns the composite version and the prefixed metadata", func() {
+			Ω(response.Version).Should(Equal(Version{"a.ID": "1.0", "b.ref": "abc"}))
+			Ω(response.Metadata).Should(ContainElement(MetadataPair{Name: "a.file", Value: "a.txt"}))
+			Ω(response.Metadata).Should(ContainElement(MetadataPair{Name: "b.dir", Value: filepath.Join(dataDir, "b")}))
+		})
+	})
+
+	Context("on in of a version without any sub-resource", func() {
+		BeforeEach(func() {
+			requestType = InType
+			version = `{"ID": "1.0"}`
+		})
+		It("returns an error", func() {
+			Ω(err).Should(MatchError(ContainSubstring(`the version {"ID":"1.0"} has no version of any composite resource`)))
+		})
+	})
+
+	Context("on in of an invalid version", func() {
+		BeforeEach(func() {
+			requestType = InType
+			version = `{"a.ID": "1.0", " ": "x"}`
+		})
+		It("validates the version as for single commands", func() {
+			Ω(err).Should(MatchError(ContainSubstring("invalid version reported by in")))
+		})
+	})
+
+	Context("on out", func() {
+		BeforeEach(func() {
+			requestType = OutType
+		})
+		It("returns an error", func() {
+			Ω(err).Should(MatchError("out is not supported by composite resources, define it in commands"))
+		})
+	})
+
+	Context("when a sub-resource name contains the separator", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "composite_invalid_name"
+			requestType = CheckType
+		})
+		It("returns an error", func() {
+			Ω(err).Should(MatchError(ContainSubstring("invalid composite resource name 'a.b'")))
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand builtins", func() {
+	BeforeEach(func() {
+		fixtureResourceName = "builtins"
+		dataDir, err = ioutil.TempDir("", "smuggler-builtins")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, dataDir, fixtureResourceName, "1.2.3")
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	Context("on check", func() {
+		BeforeEach(func() {
+			requestType = CheckType
+		})
+		It("parses the output of the builtin as the one of a command", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Versions).Should(HaveLen(1))
+			Ω(response.Versions[0]).Should(HaveKeyWithValue("time", MatchRegexp(`^\d{4}$`)))
+			Ω(command.LastCommandSuccess()).Should(BeTrue())
+		})
+	})
+
+	Context("on in", func() {
+		BeforeEach(func() {
+			requestType = InType
+		})
+		It("runs in the destination dir", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			content, err := ioutil.ReadFile(filepath.Join(dataDir, "dir", "file.txt"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(content)).Should(Equal("some content"))
+			Ω(string(command.LastCommandErr)).Should(ContainSubstring("writing "))
+		})
+	})
+
+	Context("on out", func() {
+		BeforeEach(func() {
+			requestType = OutType
+		})
+		It("reports the version of the arguments", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Version).Should(Equal(Version{"ID": "4.5.6"}))
+		})
+	})
+
+	Context("when the builtin reads the params", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "builtin_version_from_request"
+			requestType = InType
+		})
+		It("gets the same params as a command", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Version).Should(Equal(Version{"ID": "1.2.3"}))
+		})
+		It("appends the auto metadata", func() {
+			Ω(response.Metadata).Should(ContainElement(MetadataPair{Name: "smuggler_version", Value: SmugglerVersion}))
+		})
+	})
+
+	Context("when the builtin fails", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "builtin_version_from_request"
+			requestType = OutType
+		})
+		It("returns an error and exit status 1", func() {
+			Ω(err).Should(MatchError("builtin 'version' failed: no version in `with.version` or in the request"))
+			Ω(command.LastCommandExitStatus()).Should(Equal(1))
+		})
+	})
+
+	Context("when the builtin does not exist", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "builtin_unknown"
+			requestType = CheckType
+		})
+		It("returns an error listing the builtins", func() {
+			Ω(err).Should(MatchError(ContainSubstring("unknown builtin 'unknown' in 'check', must be one of: noop, timestamp, version, write_file")))
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand plugins", func() {
+	BeforeEach(func() {
+		os.Setenv("SMUGGLER_PLUGINS_DIR", "../fixtures/plugins")
+		fixtureResourceName = "plugins"
+	})
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, "/some/path", fixtureResourceName, "1.2.3")
+	})
+	AfterEach(func() {
+		os.Unsetenv("SMUGGLER_PLUGINS_DIR")
+	})
+
+	Context("on check", func() {
+		BeforeEach(func() {
+			requestType = CheckType
+		})
+		It("runs the plugin and parses its response", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Versions).Should(Equal([]Version{{"greeting": "hello"}}))
+		})
+		It("sends the plugin protocol request to stdin", func() {
+			var sent PluginRequest
+			Ω(json.Unmarshal(command.LastCommandErr, &sent)).Should(Succeed())
+			Ω(sent.Protocol).Should(Equal("smuggler-plugin/v1"))
+			Ω(sent.Action).Should(Equal(CheckType))
+			Ω(sent.With).Should(Equal(map[string]interface{}{"name": "world", "times": 2.0}))
+			Ω(sent.Source).Should(Equal(map[string]interface{}{"a_param": "a_value", "grouped_param": "grouped_value"}))
+			Ω(sent.Version).Should(Equal(Version{"ID": "1.2.3"}))
+			Ω(sent.Dir).Should(BeEmpty())
+			Ω(sent.OutputDir).ShouldNot(BeEmpty())
+		})
+	})
+
+	Context("on in", func() {
+		BeforeEach(func() {
+			requestType = InType
+		})
+		It("passes the destination dir", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(command.LastCommandErr)).Should(ContainSubstring(`"dir":"/some/path"`))
+			Ω(response.Version).Should(Equal(Version{"greeting": "hello"}))
+		})
+	})
+
+	Context("on an action not supported by the plugin", func() {
+		BeforeEach(func() {
+			requestType = OutType
+		})
+		It("returns an error", func() {
+			Ω(err).Should(MatchError("plugin 'greeter' does not support out"))
+		})
+	})
+
+	Context("when the arguments do not match the manifest", func() {
+		BeforeEach(func() {
+			requestType = CheckType
+		})
+		It("fails if a required argument is missing or has the wrong type", func() {
+			runCommandFromFixture(requestType, "/some/path", "plugin_invalid_args", "1.2.3")
+			Ω(err).Should(MatchError(ContainSubstring("plugin 'greeter' requires the argument 'name'")))
+		})
+		It("fails if an argument is unknown", func() {
+			runCommandFromFixture(requestType, "/some/path", "plugin_unknown_arg", "1.2.3")
+			Ω(err).Should(MatchError(ContainSubstring("plugin 'greeter' does not accept the argument 'colour'")))
+		})
+	})
+
+	Context("when the plugin does not exist", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "plugin_unknown"
+			requestType = CheckType
+		})
+		It("returns an error listing the plugins", func() {
+			Ω(err).Should(MatchError(ContainSubstring("unknown plugin 'unknown' in '../fixtures/plugins', found: [greeter]")))
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand starlark scripts", func() {
+	BeforeEach(func() {
+		fixtureResourceName = "starlark"
+		dataDir, err = ioutil.TempDir("", "smuggler-starlark")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, dataDir, fixtureResourceName, "1.2.3")
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	Context("on check", func() {
+		BeforeEach(func() {
+			requestType = CheckType
+		})
+		It("reports the emitted versions, with the request and params", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Versions).Should(Equal([]Version{
+				Version{"ID": "1.2.3"},
+				Version{"ID": "2.0", "param": "a_value", "count": "3"},
+			}))
+			Ω(command.LastCommandSuccess()).Should(BeTrue())
+		})
+	})
+
+	Context("on in", func() {
+		BeforeEach(func() {
+			requestType = InType
+		})
+		It("writes and reads files in the destination dir", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			content, err := ioutil.ReadFile(filepath.Join(dataDir, "dir", "file.txt"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(content)).Should(Equal(`{"ID":"1.2.3"}`))
+			Ω(response.Metadata).Should(ContainElement(MetadataPair{Name: "content", Value: `{"ID":"1.2.3"}`}))
+		})
+		It("returns the exit code of unchecked commands", func() {
+			Ω(response.Metadata).Should(ContainElement(MetadataPair{Name: "status", Value: "1"}))
+		})
+		It("prints to stderr", func() {
+			Ω(string(command.LastCommandErr)).Should(Equal("done with in\n"))
+		})
+	})
+
+	Context("on out", func() {
+		BeforeEach(func() {
+			requestType = OutType
+		})
+		It("does not allow writing outside of the data dirs", func() {
+			Ω(err).Should(MatchError(ContainSubstring("starlark script failed:")))
+			Ω(err).Should(MatchError(ContainSubstring("write_file: '/etc/smuggler' is not in any of: " + dataDir)))
+			Ω(command.LastCommandExitStatus()).Should(Equal(1))
+		})
+	})
+
+	Context("when the request_format is not json", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "starlark_request_format"
+			requestType = CheckType
+		})
+		It("gets the request anyway", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Versions).Should(Equal([]Version{Version{"ID": "1.2.3"}}))
+		})
+	})
+
+	Context("when a command run by the script fails", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "starlark_exec_fails"
+			requestType = CheckType
+		})
+		It("fails with the stderr of the command", func() {
+			Ω(err).Should(MatchError(ContainSubstring("exec: 'sh' exited with 3: failed")))
+		})
+	})
+
+	Context("when the script uses unknown names", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "starlark_invalid"
+			requestType = CheckType
+		})
+		It("fails when loading the config", func() {
+			Ω(err).Should(MatchError(ContainSubstring("invalid starlark script in 'check'")))
+			Ω(err).Should(MatchError(ContainSubstring("undefined: unknown_name")))
+			Ω(command.LastCommandOutput).Should(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand shells", func() {
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, "/some/path", fixtureResourceName, "1.2.3")
+	})
+
+	Context("when a command line starts with a shebang", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "shebang"
+		})
+		Context("on check", func() {
+			BeforeEach(func() {
+				requestType = CheckType
+			})
+			It("runs it with the interpreter and its arguments", func() {
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Versions).Should(Equal([]Version{Version{"interpreter": "perl", "ID": "1.2.3"}}))
+				Ω(command.LastCommand().Args[:3]).Should(Equal([]string{"/usr/bin/env", "perl", "-w"}))
+			})
+		})
+		Context("on in", func() {
+			BeforeEach(func() {
+				requestType = InType
+			})
+			It("passes the script in a temporary file before the arguments", func() {
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Version).Should(HaveKeyWithValue("arg", "an_arg"))
+				Ω(response.Version).Should(HaveKeyWithValue("script", ContainSubstring("smuggler-script-")))
+				_, err := os.Stat(response.Version["script"])
+				Ω(os.IsNotExist(err)).Should(BeTrue())
+			})
+		})
+	})
+
+	Context("when the shell is configured", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "shell"
+		})
+		Context("in the source", func() {
+			BeforeEach(func() {
+				requestType = CheckType
+			})
+			It("runs the commands with it and its flags", func() {
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Versions).Should(Equal([]Version{Version{"ID": "1.0"}}))
+				Ω(command.LastCommand().Path).Should(HaveSuffix("/sh"))
+				Ω(command.LastCommand().Args[1:3]).Should(Equal([]string{"-e", "-c"}))
+			})
+		})
+		Context("in the command", func() {
+			BeforeEach(func() {
+				requestType = InType
+			})
+			It("uses it, with -c as default flags", func() {
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Version).Should(Equal(Version{"arg0": "an_arg"}))
+				Ω(command.LastCommand().Path).Should(HaveSuffix("/bash"))
+				Ω(command.LastCommand().Args[1]).Should(Equal("-c"))
+			})
+		})
+	})
+
+	Context("when the configured shell does not exist", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "shell_not_found"
+			requestType = CheckType
+		})
+		It("returns an error", func() {
+			Ω(err).Should(MatchError(ContainSubstring("shell 'no-such-shell' for 'check' not found")))
+		})
+	})
+
+	Context("when the shell has no path", func() {
+		BeforeEach(func() {
+			fixtureResourceName = "shell_invalid"
+			requestType = CheckType
+		})
+		It("returns an error", func() {
+			Ω(err).Should(MatchError(ContainSubstring("shell.path is required")))
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand dry run", func() {
+	BeforeEach(func() {
+		dataDir, err = ioutil.TempDir("", "sources_dir")
+		Ω(err).ShouldNot(HaveOccurred())
+		fixtureResourceName = "dry_run"
+	})
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, dataDir, fixtureResourceName, "1.2.3")
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	Context("when calling action 'check' with smuggler_dry_run in the source", func() {
+		BeforeEach(func() {
+			requestType = CheckType
+		})
+		It("does not run the command and returns the current version", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command.LastCommand()).Should(BeNil())
+			Ω(response.Versions).Should(Equal([]Version{Version{"ID": "1.2.3"}}))
+		})
+		It("explains the command and its stdin", func() {
+			Ω(command.Explanation.Action).Should(Equal(CheckType))
+			Ω(command.Explanation.Command.Path).Should(HaveSuffix("/bash"))
+			Ω(command.Explanation.Command.Args).Should(ContainElement("exit 1"))
+			Ω(string(command.Explanation.Stdin)).Should(ContainSubstring(`"version":{"ID":"1.2.3"}`))
+			Ω(command.Explanation.String()).Should(ContainSubstring("Dry run of 'check', nothing was executed\n"))
+		})
+		It("does not run the resolvers", func() {
+			Ω(command.Explanation.Params).Should(ContainElement(ExplainedParam{
+				Name: "unresolved", Var: "SMUGGLER_unresolved", Value: "((cmd:echo a cmd secret))", Origin: OriginSource,
+			}))
+		})
+		It("explains the params set by smuggler", func() {
+			Ω(command.Explanation.Params).Should(ContainElement(ExplainedParam{
+				Name: "VERSION_ID", Var: "SMUGGLER_VERSION_ID", Value: "1.2.3", Origin: OriginSmuggler,
+			}))
+		})
+	})
+
+	Context("when calling action 'out' with smuggler_dry_run in the source", func() {
+		BeforeEach(func() {
+			requestType = OutType
+		})
+		It("returns a synthetic version", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command.LastCommand()).Should(BeNil())
+			Ω(response.Version).Should(HaveKey("dry_run"))
+			Ω(response.Metadata).Should(Equal([]MetadataPair{{Name: "dry_run", Value: "true"}}))
+		})
+		It("explains the origin of every param", func() {
+			Ω(command.Explanation.Params).Should(ContainElement(ExplainedParam{
+				Name: "overridden", Var: "SMUGGLER_overridden", Value: "from_params", Origin: OriginParams,
+			}))
+			Ω(command.Explanation.Params).Should(ContainElement(ExplainedParam{
+				Name: "source_param", Var: "SMUGGLER_source_param", Value: "from_source", Origin: OriginSource,
+			}))
+			Ω(command.Explanation.Params).Should(ContainElement(ExplainedParam{
+				Name: "smuggler_source_param", Var: "SMUGGLER_smuggler_source_param",
+				Value: "from_source_smuggler_params", Origin: OriginSourceSmugglerParams,
+			}))
+			Ω(command.Explanation.String()).Should(ContainSubstring(
+				"  SMUGGLER_overridden=*** (overridden, from params)\n"))
+		})
+		It("does not print the values of the params, which can be secrets", func() {
+			explanation := command.Explanation.String()
+			Ω(explanation).ShouldNot(ContainSubstring("from_source"))
+			Ω(explanation).ShouldNot(ContainSubstring("from_params"))
+			Ω(explanation).Should(ContainSubstring(`"overridden":"***"`))
+			Ω(explanation).Should(MatchRegexp(`SMUGGLER_SOURCES_DIR=\S+ \(SOURCES_DIR, from smuggler\)`))
+		})
+		It("does not read the smuggler_params_file, which is missing", func() {
+			Ω(command.Explanation.ParamsFile).Should(Equal("some-input/params.yml"))
+			Ω(command.Explanation.String()).Should(ContainSubstring(
+				"  and the params in smuggler_params_file 'some-input/params.yml', not read in a dry run\n"))
+		})
+	})
+
+	Context("when calling action 'in' with smuggler_dry_run in the params", func() {
+		BeforeEach(func() {
+			requestType = InType
+			fixtureResourceName = "dry_run_in_params"
+		})
+		It("does not run the command and returns the requested version", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command.LastCommand()).Should(BeNil())
+			Ω(response.Version).Should(Equal(Version{"ID": "1.2.3"}))
+			Ω(command.Explanation).ShouldNot(BeNil())
+		})
+	})
+
+	Context("when the request is merged with smuggler.yml", func() {
+		BeforeEach(func() {
+			requestType = InType
+		})
+		It("explains the params coming from it", func() {
+			request = ParseInputAndConfig(InType,
+				[]byte(`{"source":{"smuggler_dry_run":true,"smuggler_params":{"both":"request"}},"version":{"ID":"1"}}`),
+				[]byte("commands:\n  in: exit 1\nfrom_config: a\nsmuggler_params:\n  both: config\n  only_config: b\n"),
+			)
+			command = NewSmugglerCommand(logger)
+			_, err = command.RunAction(dataDir, request)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command.Explanation.Params).Should(ContainElement(ExplainedParam{
+				Name: "from_config", Var: "SMUGGLER_from_config", Value: "a", Origin: OriginConfig,
+			}))
+			Ω(command.Explanation.Params).Should(ContainElement(ExplainedParam{
+				Name: "only_config", Var: "SMUGGLER_only_config", Value: "b", Origin: OriginConfigSmugglerParams,
+			}))
+			Ω(command.Explanation.Params).Should(ContainElement(ExplainedParam{
+				Name: "both", Var: "SMUGGLER_both", Value: "request", Origin: OriginSourceSmugglerParams,
+			}))
+		})
+	})
+})
+
 func runCommandFromFixture(requestType RequestType, dataDir string, fixtureResourceName string, version string) {
 	requestJson, err = pipeline.JsonRequest(requestType, fixtureResourceName, "a_job", version)
 	Ω(err).ShouldNot(HaveOccurred())
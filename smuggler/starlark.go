@@ -0,0 +1,398 @@
+package smuggler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"go.starlark.net/starlark"
+)
+
+func (command *SmugglerCommand) runStarlark(commandDefinition CommandDefinition, params map[string]interface{}, env []string, jsonRequest []byte) error {
+	command.logger.Printf("[INFO] Running starlark script:\n%s", commandDefinition.Starlark)
+	return command.runInProcess("starlark script", func(ctx *BuiltinContext) error {
+		return runStarlark(fmt.Sprint(params["ACTION"]), commandDefinition.Starlark, ctx)
+	}, commandDefinition.With, params, env, jsonRequest)
+}
+
+// Runs a `starlark` command in process. The script gets these globals:
+//
+//	action                    "check", "in" or "out"
+//	request                   the JSON request, as for the commands
+//	params                    the params passed to the commands as SMUGGLER_*
+//	dir                       the destination or sources directory
+//	output_dir                the output directory
+//	emit_version(v)           reports a version (a dict), several for check
+//	add_metadata(name, value) reports a metadata entry
+//	read_file(path)           reads a file in dir or output_dir
+//	write_file(path, content) writes a file in dir or output_dir
+//	exec(cmd, args=[], stdin="", check=True)
+//	                          runs a command, returns {stdout, stderr, exit_code}
+//	to_json(v), from_json(s)  encodes and decodes JSON
+//
+// `print` writes to stderr.
+func runStarlark(name string, script string, ctx *BuiltinContext) error {
+	s := &starlarkRun{ctx: ctx}
+
+	var request interface{}
+	stdin, err := ioutil.ReadAll(ctx.Stdin)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(stdin, &request); err != nil {
+		return fmt.Errorf("parsing the request: %s", err)
+	}
+	requestValue, err := toStarlark(request)
+	if err != nil {
+		return err
+	}
+	paramsValue, err := toStarlark(map[string]interface{}(ctx.Params))
+	if err != nil {
+		return err
+	}
+
+	predeclared := starlark.StringDict{
+		"action":       starlark.String(ctx.Param("ACTION")),
+		"request":      requestValue,
+		"params":       paramsValue,
+		"dir":          starlark.String(s.dir()),
+		"output_dir":   starlark.String(ctx.Param("OUTPUT_DIR")),
+		"emit_version": starlark.NewBuiltin("emit_version", s.emitVersion),
+		"add_metadata": starlark.NewBuiltin("add_metadata", s.addMetadata),
+		"read_file":    starlark.NewBuiltin("read_file", s.readFile),
+		"write_file":   starlark.NewBuiltin("write_file", s.writeFile),
+		"exec":         starlark.NewBuiltin("exec", s.exec),
+		"to_json":      starlark.NewBuiltin("to_json", starlarkToJson),
+		"from_json":    starlark.NewBuiltin("from_json", starlarkFromJson),
+	}
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			fmt.Fprintln(ctx.Stderr, msg)
+		},
+	}
+	if _, err := starlark.ExecFile(thread, name+".star", script, predeclared); err != nil {
+		if evalErr, ok := err.(*starlark.EvalError); ok {
+			return fmt.Errorf("%s", evalErr.Backtrace())
+		}
+		return err
+	}
+	return s.respond()
+}
+
+var starlarkGlobals = []string{
+	"action", "request", "params", "dir", "output_dir",
+	"emit_version", "add_metadata", "read_file", "write_file", "exec",
+	"to_json", "from_json",
+}
+
+// Checks the syntax of a script and that it only uses known globals
+func validateStarlark(name string, script string) error {
+	_, _, err := starlark.SourceProgram(name+".star", script, func(global string) bool {
+		for _, g := range starlarkGlobals {
+			if g == global {
+				return true
+			}
+		}
+		return false
+	})
+	return err
+}
+
+type starlarkRun struct {
+	ctx      *BuiltinContext
+	versions []Version
+	metadata []MetadataPair
+}
+
+func (s *starlarkRun) dir() string {
+	if dir := s.ctx.Param("DESTINATION_DIR"); dir != "" {
+		return dir
+	}
+	return s.ctx.Param("SOURCES_DIR")
+}
+
+// Writes the reported versions and metadata as a JSON response, if any
+func (s *starlarkRun) respond() error {
+	if s.ctx.Param("ACTION") == string(CheckType) {
+		if s.versions == nil {
+			return nil
+		}
+		return s.ctx.Respond(s.versions)
+	}
+	if s.versions == nil && s.metadata == nil {
+		return nil
+	}
+	response := ResourceResponse{Metadata: s.metadata}
+	if len(s.versions) > 0 {
+		response.Version = s.versions[len(s.versions)-1]
+	}
+	return s.ctx.Respond(response)
+}
+
+func (s *starlarkRun) emitVersion(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v *starlark.Dict
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &v); err != nil {
+		return nil, err
+	}
+	version := make(Version)
+	for _, item := range v.Items() {
+		k, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("%s: version keys must be strings", fn.Name())
+		}
+		version[k] = starlarkToString(item[1])
+	}
+	s.versions = append(s.versions, version)
+	return starlark.None, nil
+}
+
+func (s *starlarkRun) addMetadata(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	var value starlark.Value
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name, "value", &value); err != nil {
+		return nil, err
+	}
+	s.metadata = append(s.metadata, MetadataPair{Name: name, Value: starlarkToString(value)})
+	return starlark.None, nil
+}
+
+// Resolves a path relative to dir, or output_dir for check, and only
+// allows paths inside them
+func (s *starlarkRun) allowedPath(path string) (string, error) {
+	dirs := []string{}
+	for _, d := range []string{s.dir(), s.ctx.Param("OUTPUT_DIR")} {
+		if d != "" {
+			dirs = append(dirs, filepath.Clean(d))
+		}
+	}
+	if len(dirs) == 0 {
+		return "", fmt.Errorf("no directory available to access '%s'", path)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dirs[0], path)
+	}
+	path = filepath.Clean(path)
+	for _, d := range dirs {
+		rel, err := filepath.Rel(d, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("'%s' is not in any of: %s", path, strings.Join(dirs, ", "))
+}
+
+func (s *starlarkRun) readFile(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var path string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "path", &path); err != nil {
+		return nil, err
+	}
+	path, err := s.allowedPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+	}
+	return starlark.String(b), nil
+}
+
+func (s *starlarkRun) writeFile(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var path, content string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "path", &path, "content", &content); err != nil {
+		return nil, err
+	}
+	path, err := s.allowedPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+func (s *starlarkRun) exec(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var cmd, stdin string
+	var cmdArgs *starlark.List
+	check := true
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+		"cmd", &cmd, "args?", &cmdArgs, "stdin?", &stdin, "check?", &check); err != nil {
+		return nil, err
+	}
+	var argv []string
+	if cmdArgs != nil {
+		for i := 0; i < cmdArgs.Len(); i++ {
+			argv = append(argv, starlarkToString(cmdArgs.Index(i)))
+		}
+	}
+
+	c := exec.Command(cmd, argv...)
+	c.Env = s.ctx.Env
+	c.Dir = s.dir()
+	c.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := c.Run()
+
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+	}
+	if check && exitCode != 0 {
+		return nil, fmt.Errorf("%s: '%s' exited with %d: %s", fn.Name(), cmd, exitCode, strings.TrimSpace(stderr.String()))
+	}
+
+	result := starlark.NewDict(3)
+	result.SetKey(starlark.String("stdout"), starlark.String(stdout.String()))
+	result.SetKey(starlark.String("stderr"), starlark.String(stderr.String()))
+	result.SetKey(starlark.String("exit_code"), starlark.MakeInt(exitCode))
+	return result, nil
+}
+
+func starlarkToJson(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v starlark.Value
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &v); err != nil {
+		return nil, err
+	}
+	goValue, err := fromStarlark(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+	}
+	b, err := json.Marshal(goValue)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+	}
+	return starlark.String(b), nil
+}
+
+func starlarkFromJson(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &s); err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+	}
+	return toStarlark(v)
+}
+
+// Strings without quotes, other values as JSON
+func starlarkToString(v starlark.Value) string {
+	if s, ok := starlark.AsString(v); ok {
+		return s
+	}
+	goValue, err := fromStarlark(v)
+	if err != nil {
+		return v.String()
+	}
+	return InterfaceToJsonString(goValue)
+}
+
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(v), nil
+	case float64:
+		if v == float64(int64(v)) {
+			return starlark.MakeInt64(int64(v)), nil
+		}
+		return starlark.Float(v), nil
+	case int:
+		return starlark.MakeInt(v), nil
+	case string:
+		return starlark.String(v), nil
+	case []interface{}:
+		elems := make([]starlark.Value, len(v))
+		for i, e := range v {
+			var err error
+			if elems[i], err = toStarlark(e); err != nil {
+				return nil, err
+			}
+		}
+		return starlark.NewList(elems), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		d := starlark.NewDict(len(v))
+		for _, k := range keys {
+			e, err := toStarlark(v[k])
+			if err != nil {
+				return nil, err
+			}
+			d.SetKey(starlark.String(k), e)
+		}
+		return d, nil
+	}
+	// Other types, like Version, via their JSON representation
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return nil, err
+	}
+	return toStarlark(generic)
+}
+
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return i, nil
+		}
+		return nil, fmt.Errorf("integer %s is too big", v)
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Indexable:
+		l := make([]interface{}, v.Len())
+		for i := range l {
+			var err error
+			if l[i], err = fromStarlark(v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return l, nil
+	case *starlark.Dict:
+		m := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			k, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("dict keys must be strings, not %s", item[0].Type())
+			}
+			var err error
+			if m[k], err = fromStarlark(item[1]); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("can not convert %s to JSON", v.Type())
+}
@@ -0,0 +1,312 @@
+package smuggler
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// Test cases for a resource config, run by `smuggler test`. The source and
+// config apply to all the cases; a case can override the source.
+type TestSuite struct {
+	Name string `json:"name,omitempty"`
+	// `smuggler.yml` to merge into the source, relative to the suite file
+	Config string                 `json:"config,omitempty"`
+	Source map[string]interface{} `json:"source,omitempty"`
+	Cases  []TestCase             `json:"cases"`
+
+	path string
+}
+
+type TestCase struct {
+	Name    string                 `json:"name"`
+	Action  RequestType            `json:"action"`
+	Source  map[string]interface{} `json:"source,omitempty"`
+	Params  map[string]interface{} `json:"params,omitempty"`
+	Version Version                `json:"version,omitempty"`
+	// Files to create in the sources directory (or the destination
+	// directory for `in`, and the working directory for `check`)
+	Files  map[string]string `json:"files,omitempty"`
+	Expect TestExpectations  `json:"expect"`
+}
+
+type TestExpectations struct {
+	Versions   []Version         `json:"versions,omitempty"`
+	Version    Version           `json:"version,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Files      map[string]string `json:"files,omitempty"`
+	ExitStatus int               `json:"exit_status,omitempty"`
+	// Regular expressions that stderr must match
+	Stderr []string `json:"stderr,omitempty"`
+}
+
+type TestResult struct {
+	Suite    string
+	Case     string
+	Duration time.Duration
+	Failures []string
+	Stderr   string
+}
+
+func (r TestResult) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+func LoadTestSuite(path string) (*TestSuite, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var suite TestSuite
+	if err := yaml.Unmarshal(b, &suite); err != nil {
+		return nil, fmt.Errorf("parsing test suite '%s': %s", path, err)
+	}
+	if suite.Name == "" {
+		suite.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	suite.path = path
+	for i, c := range suite.Cases {
+		switch c.Action {
+		case CheckType, InType, OutType:
+		default:
+			return nil, fmt.Errorf("invalid action '%s' in case %d of '%s', must be one of: check, in, out", c.Action, i+1, path)
+		}
+		if c.Name == "" {
+			suite.Cases[i].Name = fmt.Sprintf("%s #%d", c.Action, i+1)
+		}
+	}
+	return &suite, nil
+}
+
+// Runs the cases with the smuggler binary, each one in a new temporary
+// directory
+func (suite *TestSuite) Run(binary string) []TestResult {
+	results := make([]TestResult, 0, len(suite.Cases))
+	for _, c := range suite.Cases {
+		start := time.Now()
+		result := TestResult{Suite: suite.Name, Case: c.Name}
+		if err := suite.runCase(binary, c, &result); err != nil {
+			result.Failures = append(result.Failures, err.Error())
+		}
+		result.Duration = time.Since(start)
+		results = append(results, result)
+	}
+	return results
+}
+
+func (suite *TestSuite) runCase(binary string, c TestCase, result *TestResult) error {
+	tmpDir, err := ioutil.TempDir("", "smuggler-test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	dataDir := filepath.Join(tmpDir, "dir")
+	for path, content := range c.Files {
+		path = filepath.Join(dataDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+
+	source := c.Source
+	if source == nil {
+		source = suite.Source
+	}
+	request := RawResourceRequest{Source: source, Params: c.Params}
+	if c.Action != OutType {
+		request.Version = c.Version
+	}
+	input, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	config := ""
+	if suite.Config != "" {
+		// The command runs in the data directory
+		config, err = filepath.Abs(filepath.Join(filepath.Dir(suite.path), suite.Config))
+		if err != nil {
+			return err
+		}
+	}
+	args := []string{string(c.Action)}
+	if c.Action != CheckType {
+		args = append(args, dataDir)
+	}
+	cmd := exec.Command(binary, args...)
+	cmd.Dir = dataDir
+	cmd.Env = append(os.Environ(),
+		"SMUGGLER_LOG="+filepath.Join(tmpDir, "smuggler.log"),
+		"SMUGGLER_CONFIG="+config,
+		ActionEnv+"=",
+	)
+	cmd.Stdin = bytes.NewBuffer(input)
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	result.Stderr = stderr.String()
+
+	exitStatus := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitStatus = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+	} else if err != nil {
+		return err
+	}
+	result.Failures = append(result.Failures, c.Expect.check(c.Action, exitStatus, stdout.Bytes(), stderr.String(), dataDir)...)
+	return nil
+}
+
+func (expect TestExpectations) check(action RequestType, exitStatus int, stdout []byte, stderr string, dataDir string) []string {
+	var failures []string
+	failf := func(format string, args ...interface{}) {
+		failures = append(failures, fmt.Sprintf(format, args...))
+	}
+
+	if exitStatus != expect.ExitStatus {
+		failf("expected exit status %d, got %d", expect.ExitStatus, exitStatus)
+	}
+	for _, pattern := range expect.Stderr {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			failf("invalid stderr pattern '%s': %s", pattern, err)
+		} else if !re.MatchString(stderr) {
+			failf("expected stderr to match '%s'", pattern)
+		}
+	}
+
+	if exitStatus == 0 {
+		var response ResourceResponse
+		var err error
+		if action == CheckType {
+			err = json.Unmarshal(stdout, &response.Versions)
+		} else {
+			err = json.Unmarshal(stdout, &response)
+		}
+		if err != nil {
+			failf("invalid response '%s': %s", strings.TrimSpace(string(stdout)), err)
+		}
+		if expect.Versions != nil && !reflect.DeepEqual(expect.Versions, response.Versions) {
+			failf("expected versions %s, got %s", InterfaceToJsonString(expect.Versions), InterfaceToJsonString(response.Versions))
+		}
+		if expect.Version != nil && !reflect.DeepEqual(expect.Version, response.Version) {
+			failf("expected version %s, got %s", InterfaceToJsonString(expect.Version), InterfaceToJsonString(response.Version))
+		}
+		for name, value := range expect.Metadata {
+			if !hasMetadata(response.Metadata, name, value) {
+				failf("expected metadata '%s' with value '%s', got %s", name, value, InterfaceToJsonString(response.Metadata))
+			}
+		}
+	}
+
+	for path, content := range expect.Files {
+		b, err := ioutil.ReadFile(filepath.Join(dataDir, path))
+		if err != nil {
+			failf("expected file '%s': %s", path, err)
+		} else if string(b) != content {
+			failf("expected file '%s' with content '%s', got '%s'", path, content, string(b))
+		}
+	}
+	return failures
+}
+
+func hasMetadata(metadata []MetadataPair, name string, value string) bool {
+	for _, m := range metadata {
+		if m.Name == name && m.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitFailure struct {
+	Message  string `xml:"message,attr"`
+	Contents string `xml:",chardata"`
+}
+
+// Writes the results as a JUnit XML report, grouped by suite
+func WriteJUnitReport(w io.Writer, results []TestResult) error {
+	var report junitTestSuites
+	index := map[string]int{}
+	durations := map[string]time.Duration{}
+	for _, r := range results {
+		i, ok := index[r.Suite]
+		if !ok {
+			i = len(report.Suites)
+			index[r.Suite] = i
+			report.Suites = append(report.Suites, junitTestSuite{Name: r.Suite})
+		}
+		suite := &report.Suites[i]
+		testCase := junitTestCase{
+			Name:      r.Case,
+			ClassName: r.Suite,
+			Time:      fmt.Sprintf("%.3f", r.Duration.Seconds()),
+		}
+		if !r.Passed() {
+			suite.Failures++
+			testCase.Failure = &junitFailure{
+				Message:  r.Failures[0],
+				Contents: strings.Join(r.Failures, "\n"),
+			}
+			testCase.SystemErr = r.Stderr
+		}
+		suite.Tests++
+		durations[r.Suite] += r.Duration
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	for i := range report.Suites {
+		report.Suites[i].Time = fmt.Sprintf("%.3f", durations[report.Suites[i].Name].Seconds())
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
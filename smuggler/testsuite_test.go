@@ -0,0 +1,38 @@
+package smuggler_test
+
+import (
+	"bytes"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+var _ = Describe("TestSuite", func() {
+	It("loads the cases, named after their action by default", func() {
+		suite, err := LoadTestSuite("../fixtures/tests/failing.yml")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(suite.Name).Should(Equal("failing"))
+		Ω(suite.Cases).Should(HaveLen(1))
+		Ω(suite.Cases[0].Name).Should(Equal("check #1"))
+		Ω(suite.Cases[0].Expect.Versions).Should(Equal([]Version{{"ID": "2.0"}}))
+	})
+
+	It("writes a JUnit report grouped by suite", func() {
+		b := new(bytes.Buffer)
+		err := WriteJUnitReport(b, []TestResult{
+			{Suite: "a", Case: "passes", Duration: time.Second},
+			{Suite: "a", Case: "fails", Failures: []string{"first", "second"}, Stderr: "some error"},
+			{Suite: "b", Case: "passes"},
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		report := b.String()
+		Ω(report).Should(ContainSubstring(`<testsuite name="a" tests="2" failures="1" time="1.000">`))
+		Ω(report).Should(ContainSubstring(`<testcase name="passes" classname="a" time="1.000"></testcase>`))
+		Ω(report).Should(ContainSubstring(`<failure message="first">first&#xA;second</failure>`))
+		Ω(report).Should(ContainSubstring(`<system-err>some error</system-err>`))
+		Ω(report).Should(ContainSubstring(`<testsuite name="b" tests="1" failures="0" time="0.000">`))
+	})
+})
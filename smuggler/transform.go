@@ -0,0 +1,247 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Declarative transformation of a JSON document, like a request or a
+// response. Each operation must define only one of the actions.
+// Paths are keys separated by dots, e.g. `source.bucket`.
+type TransformOperation struct {
+	Set         map[string]interface{} `json:"set,omitempty"`
+	Default     map[string]interface{} `json:"default,omitempty"`
+	Delete      []string               `json:"delete,omitempty"`
+	Rename      map[string]string      `json:"rename,omitempty"`
+	MapVersions []TransformOperation   `json:"map_versions,omitempty"`
+}
+
+// A transformation is either a list of operations or a query, see Query
+type Transformation struct {
+	Query      *Query
+	Operations []TransformOperation
+}
+
+func (t *Transformation) UnmarshalJSON(b []byte) error {
+	var source string
+	if err := json.Unmarshal(b, &source); err == nil {
+		t.Query, err = CompileQuery(source)
+		return err
+	}
+	return json.Unmarshal(b, &t.Operations)
+}
+
+func (t Transformation) MarshalJSON() ([]byte, error) {
+	if t.Query != nil {
+		return json.Marshal(t.Query.String())
+	}
+	return json.Marshal(t.Operations)
+}
+
+func (t Transformation) IsEmpty() bool {
+	return t.Query == nil && len(t.Operations) == 0
+}
+
+func (t Transformation) Validate() error {
+	for _, op := range t.Operations {
+		if err := op.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the transformation to a document decoded from JSON. A query must
+// return exactly one value.
+func (t Transformation) Apply(doc interface{}) (interface{}, error) {
+	if t.Query != nil {
+		return t.Query.RunOne(doc)
+	}
+	return Transform(doc, t.Operations)
+}
+
+func (op TransformOperation) Validate() error {
+	actions := 0
+	for _, defined := range []bool{
+		op.Set != nil, op.Default != nil, op.Delete != nil, op.Rename != nil, op.MapVersions != nil,
+	} {
+		if defined {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("each transform operation must have one of: set, default, delete, rename, map_versions")
+	}
+	for _, o := range op.MapVersions {
+		if err := o.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the operations to a document decoded from JSON
+func Transform(doc interface{}, ops []TransformOperation) (interface{}, error) {
+	for _, op := range ops {
+		if err := op.Validate(); err != nil {
+			return nil, err
+		}
+		var err error
+		doc, err = op.apply(doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// Apply the transformation to a struct, via its JSON representation
+func TransformStruct(v interface{}, t Transformation) error {
+	if t.IsEmpty() {
+		return nil
+	}
+	doc, err := toJsonDocument(v)
+	if err != nil {
+		return err
+	}
+	doc, err = t.Apply(doc)
+	if err != nil {
+		return err
+	}
+	// Start from the zero value, so that deleted keys are not kept
+	rv := reflect.ValueOf(v).Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	return fromJsonDocument(doc, v)
+}
+
+func (op TransformOperation) apply(doc interface{}) (interface{}, error) {
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		if doc != nil {
+			return nil, fmt.Errorf("can not transform %s, it is not a map", InterfaceToJsonString(doc))
+		}
+		m = make(map[string]interface{})
+	}
+
+	for from, to := range op.Rename {
+		if v, ok := getPath(m, from); ok {
+			deletePath(m, from)
+			setPath(m, to, v)
+		}
+	}
+	for _, p := range op.Delete {
+		deletePath(m, p)
+	}
+	for p, v := range op.Set {
+		setPath(m, p, v)
+	}
+	for p, v := range op.Default {
+		if _, ok := getPath(m, p); !ok {
+			setPath(m, p, v)
+		}
+	}
+	if op.MapVersions != nil {
+		if err := mapVersions(m, op.MapVersions); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Apply the operations to `version` and to each of `versions`,
+// converting the values back to strings as required by concourse
+func mapVersions(m map[string]interface{}, ops []TransformOperation) error {
+	transformVersion := func(v interface{}) (interface{}, error) {
+		v, err := Transform(v, ops)
+		if err != nil {
+			return nil, err
+		}
+		return stringifyVersion(v)
+	}
+
+	if v, ok := m["version"]; ok {
+		var err error
+		if m["version"], err = transformVersion(v); err != nil {
+			return err
+		}
+	}
+	if vs, ok := m["versions"].([]interface{}); ok {
+		for i, v := range vs {
+			var err error
+			if vs[i], err = transformVersion(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func getPath(m map[string]interface{}, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := m[k].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		m = next
+	}
+	v, ok := m[keys[len(keys)-1]]
+	return v, ok
+}
+
+func setPath(m map[string]interface{}, path string, v interface{}) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := m[k].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			m[k] = next
+		}
+		m = next
+	}
+	m[keys[len(keys)-1]] = v
+}
+
+func deletePath(m map[string]interface{}, path string) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := m[k].(map[string]interface{})
+		if !ok {
+			return
+		}
+		m = next
+	}
+	delete(m, keys[len(keys)-1])
+}
+
+// Concourse versions only have string values
+func stringifyVersion(v interface{}) (interface{}, error) {
+	version, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("version %s is not a map", InterfaceToJsonString(v))
+	}
+	for k, value := range version {
+		version[k] = InterfaceToJsonString(value)
+	}
+	return version, nil
+}
+
+func toJsonDocument(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	err = json.Unmarshal(b, &doc)
+	return doc, err
+}
+
+func fromJsonDocument(doc interface{}, v interface{}) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,59 @@
+package smuggler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Check that the response is something that concourse would accept,
+// giving a hint of how to fix it otherwise, with the variables named as
+// for the commands.
+func validateResponse(response *ResourceResponse, envNaming EnvNaming) error {
+	versionsFile := fmt.Sprintf("${%s}/versions", envNaming.VarName("OUTPUT_DIR"))
+	switch response.Type {
+	case CheckType:
+		seen := make(map[string]int, len(response.Versions))
+		for i, v := range response.Versions {
+			if err := validateVersion(v); err != nil {
+				return fmt.Errorf("invalid version #%d reported by check: %s", i+1, err)
+			}
+			key := InterfaceToJsonString(v)
+			if j, ok := seen[key]; ok {
+				return fmt.Errorf(
+					"check reported the version %s twice (#%d and #%d): "+
+						"each version must appear only once in %s or the stdout JSON",
+					key, j+1, i+1, versionsFile,
+				)
+			}
+			seen[key] = i
+		}
+	case OutType:
+		if len(response.Version) == 0 {
+			return fmt.Errorf(
+				"out did not report any version: write it to %s "+
+					"or print a JSON response with a 'version' to stdout",
+				versionsFile,
+			)
+		}
+		fallthrough
+	case InType:
+		if len(response.Version) > 0 {
+			if err := validateVersion(response.Version); err != nil {
+				return fmt.Errorf("invalid version reported by %s: %s", response.Type, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateVersion(v Version) error {
+	if len(v) == 0 {
+		return fmt.Errorf("the version is empty")
+	}
+	for k := range v {
+		if strings.TrimSpace(k) == "" {
+			return fmt.Errorf("the version %s has an empty key", InterfaceToJsonString(v))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+)
+
+// Configuration to wrap another resource, whose check/in/out commands
+// are in `path`
+type WrapConfig struct {
+	Path                string         `json:"path"`
+	TransformRequest    Transformation `json:"transform_request,omitempty"`
+	TransformResponse   Transformation `json:"transform_response,omitempty"`
+	DefaultCheckVersion Version        `json:"default_check_version,omitempty"`
+	DefaultVersionIn    interface{}    `json:"default_version_in,omitempty"`
+}
+
+func (wrap *WrapConfig) Validate() error {
+	if wrap.Path == "" {
+		return fmt.Errorf("wrap.path is required")
+	}
+	if err := wrap.TransformRequest.Validate(); err != nil {
+		return err
+	}
+	return wrap.TransformResponse.Validate()
+}
+
+func (wrap *WrapConfig) IsDefaultVersion(v Version) bool {
+	return len(wrap.DefaultCheckVersion) > 0 && reflect.DeepEqual(wrap.DefaultCheckVersion, v)
+}
+
+// Returns the command of the wrapped resource for the action, and if it
+// is the wrapped resource. For `in` of the default version returns
+// `default_version_in` instead, or nil if not defined.
+func (wrap *WrapConfig) FindCommand(request *ResourceRequest, dataDir string) (*CommandDefinition, bool, error) {
+	if request.Type == InType && wrap.IsDefaultVersion(request.Version) {
+		if wrap.DefaultVersionIn == nil {
+			return nil, false, nil
+		}
+		c, err := parseCommand("default_version_in", wrap.DefaultVersionIn, request.Source.Shell)
+		return c, false, err
+	}
+
+	c := &CommandDefinition{
+		Path: filepath.Join(wrap.Path, string(request.Type)),
+	}
+	if request.Type != CheckType {
+		c.Args = []string{dataDir}
+	}
+	return c, true, nil
+}
+
+// The filtered request, transformed with `transform_request`
+func (wrap *WrapConfig) prepareJsonRequest(request *ResourceRequest) ([]byte, error) {
+	var r RawResourceRequest
+	if request.FilteredRequest != nil {
+		r = *request.FilteredRequest
+	}
+	if err := TransformStruct(&r, wrap.TransformRequest); err != nil {
+		return nil, err
+	}
+	return json.Marshal(r)
+}
+
+// Apply `transform_response` and `default_check_version` to the response
+// of the wrapped resource
+func (wrap *WrapConfig) transformResponse(response *ResourceResponse) error {
+	var err error
+	if wrap.TransformResponse.Query != nil {
+		err = wrap.queryResponse(response)
+	} else {
+		responseType := response.Type
+		err = TransformStruct(response, wrap.TransformResponse)
+		response.Type = responseType
+	}
+	if err != nil {
+		return err
+	}
+
+	if response.Type == CheckType && len(response.Versions) == 0 && len(wrap.DefaultCheckVersion) > 0 {
+		response.Versions = []Version{wrap.DefaultCheckVersion}
+	}
+	return nil
+}
+
+// Queries get the response as concourse expects it: the list of versions
+// for check, or the version and metadata for in/out
+func (wrap *WrapConfig) queryResponse(response *ResourceResponse) error {
+	var doc interface{}
+	var err error
+	if response.Type == CheckType {
+		doc, err = toJsonDocument(response.Versions)
+	} else {
+		doc, err = toJsonDocument(response)
+	}
+	if err != nil {
+		return err
+	}
+	doc, err = wrap.TransformResponse.Apply(doc)
+	if err != nil {
+		return err
+	}
+
+	result := ResourceResponse{Type: response.Type}
+	if response.Type == CheckType {
+		versions, ok := doc.([]interface{})
+		if !ok {
+			return fmt.Errorf("transform_response must return a list of versions, not %s", InterfaceToJsonString(doc))
+		}
+		for _, v := range versions {
+			if _, err := stringifyVersion(v); err != nil {
+				return err
+			}
+		}
+		err = fromJsonDocument(versions, &result.Versions)
+	} else {
+		if m, ok := doc.(map[string]interface{}); ok && m["version"] != nil {
+			if _, err := stringifyVersion(m["version"]); err != nil {
+				return err
+			}
+		}
+		err = fromJsonDocument(doc, &result)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid response from transform_response: %s", err)
+	}
+	*response = result
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -186,6 +187,17 @@ var _ = Describe("smuggler commands", func() {
 		})
 	})
 
+	Context("when smuggler fails after running the command successfully", func() {
+		BeforeEach(func() {
+			expectedExitStatus = 1
+			commandPath, dataDir, jsonRequest = prepareCommandOut("invalid_responses")
+		})
+
+		It("returns an error", func() {
+			Ω(session.Err).Should(gbytes.Say("error running command: out did not report any version"))
+		})
+	})
+
 	Context("when there is local config file 'smuggler.yml' that is empty", func() {
 		BeforeEach(func() {
 			configPath = "./fixtures/empty_smuggler.yml"
@@ -338,6 +350,468 @@ var _ = Describe("smuggler commands", func() {
 
 })
 
+var _ = Describe("smuggler encrypt", func() {
+	runEncrypt := func(args ...string) *gexec.Session {
+		command := exec.Command(smugglerPath, append([]string{"encrypt"}, args...)...)
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-session.Exited
+		return session
+	}
+
+	It("generates a key and encrypts a value that can be decrypted", func() {
+		session := runEncrypt("-generate-key")
+		Expect(session.ExitCode()).To(Equal(0))
+
+		keyFile, err := ioutil.TempFile("", "smuggler.key")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Remove(keyFile.Name())
+		_, err = keyFile.Write(session.Out.Contents())
+		Ω(err).ShouldNot(HaveOccurred())
+		keyFile.Close()
+
+		session = runEncrypt("-key-file", keyFile.Name(), "a secret")
+		Expect(session.ExitCode()).To(Equal(0))
+
+		key, err := ReadEncryptionKeyFile(keyFile.Name())
+		Ω(err).ShouldNot(HaveOccurred())
+		value, err := DecryptValue(key, strings.TrimSpace(string(session.Out.Contents())))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(value).Should(Equal("a secret"))
+	})
+
+	It("encrypts with the public key a value that can be decrypted with the key", func() {
+		session := runEncrypt("-key-file", "fixtures/decryption.key", "-print-public-key")
+		Expect(session.ExitCode()).To(Equal(0))
+
+		publicKeyFile, err := ioutil.TempFile("", "smuggler.pub")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Remove(publicKeyFile.Name())
+		_, err = publicKeyFile.Write(session.Out.Contents())
+		Ω(err).ShouldNot(HaveOccurred())
+		publicKeyFile.Close()
+
+		session = runEncrypt("-public-key-file", publicKeyFile.Name(), "a secret")
+		Expect(session.ExitCode()).To(Equal(0))
+		sealed := strings.TrimSpace(string(session.Out.Contents()))
+		Ω(sealed).Should(HavePrefix(SealedValuePrefix))
+
+		key, err := ReadEncryptionKeyFile("fixtures/decryption.key")
+		Ω(err).ShouldNot(HaveOccurred())
+		value, err := DecryptValue(key, sealed)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(value).Should(Equal("a secret"))
+	})
+
+	It("fails without a key", func() {
+		session := runEncrypt("a secret")
+		Expect(session.ExitCode()).To(Equal(1))
+		Ω(session.Err).Should(gbytes.Say("usage:"))
+	})
+})
+
+var _ = Describe("smuggler query", func() {
+	runQuery := func(input string, args ...string) *gexec.Session {
+		command := exec.Command(smugglerPath, append([]string{"query"}, args...)...)
+		command.Stdin = strings.NewReader(input)
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-session.Exited
+		return session
+	}
+
+	It("prints the outputs of the query as JSON", func() {
+		session := runQuery(`{"source": {"bucket": "a_bucket", "tags": ["a", "b"]}}`, ".source.bucket, .source.tags")
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(string(session.Out.Contents())).Should(Equal("\"a_bucket\"\n[\n  \"a\",\n  \"b\"\n]\n"))
+	})
+
+	It("prints raw strings and compact JSON", func() {
+		session := runQuery(`{"source": {"bucket": "a_bucket", "tags": ["a", "b"]}}`, "-r", "-c", ".source.bucket, .source.tags")
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(string(session.Out.Contents())).Should(Equal("a_bucket\n[\"a\",\"b\"]\n"))
+	})
+
+	It("exits with 1 with -e when the output is false or null", func() {
+		session := runQuery(`{}`, "-e", ".missing")
+		Expect(session.ExitCode()).To(Equal(1))
+	})
+
+	It("fails with an invalid query", func() {
+		session := runQuery(`{}`, ".[")
+		Expect(session.ExitCode()).To(Equal(1))
+		Ω(session.Err).Should(gbytes.Say("invalid query"))
+	})
+})
+
+var _ = Describe("smuggler builtins", func() {
+	It("lists the builtins with their arguments", func() {
+		command := exec.Command(smugglerPath, "builtins")
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-session.Exited
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).Should(gbytes.Say("noop: "))
+		Ω(session.Out).Should(gbytes.Say("timestamp: "))
+		Ω(session.Out).Should(gbytes.Say(`    with.format: `))
+		Ω(session.Out).Should(gbytes.Say("write_file: "))
+	})
+})
+
+var _ = Describe("smuggler subcommands", func() {
+	var session *gexec.Session
+
+	run := func(env []string, stdin string, args ...string) {
+		logFile, err := ioutil.TempFile("", "smuggler.log")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Remove(logFile.Name())
+
+		command := exec.Command(smugglerPath, args...)
+		command.Stdin = bytes.NewBufferString(stdin)
+		command.Env = append(append(os.Environ(), "SMUGGLER_LOG="+logFile.Name()), env...)
+		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-session.Exited
+	}
+
+	It("runs the action given as argument", func() {
+		run(nil, getJsonRequest(CheckType, "complex_command"), "check")
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).Should(gbytes.Say(`"ID":"1.2.3"`))
+	})
+
+	It("runs the action in SMUGGLER_RESOURCE_ACTION", func() {
+		dataDir, err := ioutil.TempDir("", "smuggler-action")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dataDir)
+
+		run([]string{"SMUGGLER_RESOURCE_ACTION=in"}, getJsonRequest(InType, "complex_command"), dataDir)
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).Should(gbytes.Say(`"version"`))
+	})
+
+	It("runs subcommands called from the commands of an action", func() {
+		run([]string{"SMUGGLER_ACTION=in", "SMUGGLER_RESOURCE_ACTION=in"}, `{"a":["x"]}`, "query", "-r", ".a[]")
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).Should(gbytes.Say("^x\n"))
+	})
+
+	It("fails without the directory of in", func() {
+		run(nil, "", "in")
+		Expect(session.ExitCode()).To(Equal(1))
+		Ω(session.Err).Should(gbytes.Say("missing destination directory for 'in'"))
+	})
+
+	It("prints the usage without arguments", func() {
+		run(nil, "")
+		Expect(session.ExitCode()).To(Equal(1))
+		Ω(session.Err).Should(gbytes.Say("usage: "))
+	})
+
+	It("prints the help", func() {
+		run(nil, "", "help")
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).Should(gbytes.Say("Resource actions"))
+		Ω(session.Out).Should(gbytes.Say("SMUGGLER_RESOURCE_ACTION"))
+	})
+
+	It("prints the version", func() {
+		run(nil, "", "version")
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).Should(gbytes.Say(`^smuggler dev\n`))
+	})
+})
+
+var _ = Describe("smuggler run", func() {
+	var session *gexec.Session
+	var dataDir string
+
+	run := func(args ...string) {
+		logFile, err := ioutil.TempFile("", "smuggler.log")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Remove(logFile.Name())
+
+		command := exec.Command(smugglerPath, append([]string{"run"}, args...)...)
+		command.Env = append(os.Environ(), "SMUGGLER_LOG="+logFile.Name(), "SMUGGLER_CONFIG=")
+		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-session.Exited
+	}
+
+	BeforeEach(func() {
+		dataDir, err = ioutil.TempDir("", "smuggler-run")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	It("runs check with the source of the resource", func() {
+		run("-pipeline", "fixtures/pipeline.yml", "-resource", "complex_command", "check")
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).Should(gbytes.Say(`\[{"ID":"1.2.3"},{"ID":"1.2.4"}\]`))
+	})
+
+	It("runs in with the params of the job and the version", func() {
+		run("-pipeline", "fixtures/pipeline.yml", "-resource", "complex_command", "-job", "a_job",
+			"in", "-version", "4.5.6", "-dir", dataDir)
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(session.Err).Should(gbytes.Say("param4=val4"))
+		Ω(session.Out).Should(gbytes.Say(`"version":{"ID":"4.5.6"}`))
+	})
+
+	It("fails with unknown resources", func() {
+		run("-pipeline", "fixtures/pipeline.yml", "-resource", "unknown", "check")
+		Expect(session.ExitCode()).To(Equal(1))
+		Ω(session.Err).Should(gbytes.Say("Cannot find a resource called 'unknown'"))
+	})
+
+	It("prints the usage without action", func() {
+		run("-pipeline", "fixtures/pipeline.yml", "-resource", "complex_command")
+		Expect(session.ExitCode()).To(Equal(1))
+		Ω(session.Err).Should(gbytes.Say("usage: "))
+	})
+})
+
+var _ = Describe("smuggler explain", func() {
+	var session *gexec.Session
+
+	explain := func(request string, args ...string) {
+		logFile, err := ioutil.TempFile("", "smuggler.log")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Remove(logFile.Name())
+
+		command := exec.Command(smugglerPath, append([]string{"explain"}, args...)...)
+		command.Env = append(os.Environ(), "SMUGGLER_LOG="+logFile.Name(), "SMUGGLER_CONFIG=")
+		command.Stdin = strings.NewReader(request)
+		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-session.Exited
+	}
+
+	It("prints the command and params without running it", func() {
+		explain(`{"source":{"commands":{"out":"exit 1"}},"params":{"a_param":"a_value"}}`, "out", "/some/path")
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).Should(gbytes.Say("Dry run of 'out', nothing was executed"))
+		Ω(session.Out).Should(gbytes.Say("Config: none"))
+		Ω(session.Out).Should(gbytes.Say(`Command: .*bash .*'exit 1'`))
+		Ω(session.Out).Should(gbytes.Say(`SMUGGLER_SOURCES_DIR=/some/path \(SOURCES_DIR, from smuggler\)`))
+		Ω(session.Out).Should(gbytes.Say(`SMUGGLER_a_param=\*\*\* \(a_param, from params\)`))
+		Ω(string(session.Out.Contents())).ShouldNot(ContainSubstring("a_value"))
+		Ω(session.Out).Should(gbytes.Say(`Response:\n  {"version":{"dry_run":`))
+	})
+
+	It("prints the smuggler.yml found", func() {
+		explain(`{"source":{}}`, "-config", "fixtures/full_smuggler.yml", "check")
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).Should(gbytes.Say("Config: fixtures/full_smuggler.yml"))
+		Ω(session.Out).Should(gbytes.Say(`SMUGGLER_config_param1=\*\*\* \(config_param1, from smuggler.yml smuggler_params\)`))
+	})
+
+	It("fails with unknown actions", func() {
+		explain(`{}`, "unknown")
+		Expect(session.ExitCode()).To(Equal(1))
+		Ω(session.Err).Should(gbytes.Say("unknown action 'unknown'"))
+	})
+})
+
+var _ = Describe("smuggler lint", func() {
+	var session *gexec.Session
+
+	lint := func(args ...string) {
+		command := exec.Command(smugglerPath, append([]string{"lint"}, args...)...)
+		var err error
+		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-session.Exited
+	}
+
+	It("reports the issues and fails if there are errors", func() {
+		lint("-pipeline", "fixtures/lint/pipeline.yml")
+		Expect(session.ExitCode()).To(Equal(1))
+		Ω(session.Out).Should(gbytes.Say(`error: files out \(job build, step files\): SMUGGLER_traget_file is not defined`))
+		Ω(session.Out).Should(gbytes.Say(`warning: files: param 'unused_source_param' of the source is not used by any command`))
+		Ω(session.Out).Should(gbytes.Say("5 errors, 2 warnings"))
+	})
+
+	It("succeeds when the resources have no commands", func() {
+		lint("-pipeline", "fixtures/lint/pipeline.yml", "-type", "git")
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(session.Out.Contents()).Should(BeEmpty())
+	})
+
+	It("prints the usage without pipeline", func() {
+		lint()
+		Expect(session.ExitCode()).To(Equal(1))
+		Ω(session.Err).Should(gbytes.Say("usage: "))
+	})
+})
+
+var _ = Describe("smuggler simulate", func() {
+	It("runs check repeatedly with the newest version", func() {
+		logFile, err := ioutil.TempFile("", "smuggler.log")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Remove(logFile.Name())
+		dataDir, err := ioutil.TempDir("", "smuggler-simulate")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dataDir)
+		historyPath := filepath.Join(dataDir, "history.json")
+
+		command := exec.Command(smugglerPath, "simulate", "-pipeline", "fixtures/pipeline.yml",
+			"-resource", "counter", "-iterations", "3", "-history", historyPath, "-in", "-dir", dataDir)
+		command.Env = append(os.Environ(), "SMUGGLER_LOG="+logFile.Name(), "SMUGGLER_CONFIG=")
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-session.Exited
+
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).Should(gbytes.Say(`check #1 from no version: 1 versions, 1 new`))
+		Ω(session.Out).Should(gbytes.Say(`check #3 from {"ID":"2"}: 2 versions, 1 new`))
+
+		history, err := LoadVersionHistory(historyPath)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(history.Versions).Should(Equal(NewVersions([]string{"1", "2", "3"})))
+		content, err := ioutil.ReadFile(filepath.Join(dataDir, "3", "counter"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(content)).Should(Equal("3\n"))
+	})
+})
+
+var _ = Describe("smuggler test", func() {
+	var session *gexec.Session
+	var reportPath string
+
+	run := func(args ...string) {
+		report, err := ioutil.TempFile("", "junit.xml")
+		Ω(err).ShouldNot(HaveOccurred())
+		reportPath = report.Name()
+
+		command := exec.Command(smugglerPath, append([]string{"test", "-junit", reportPath}, args...)...)
+		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-session.Exited
+	}
+	AfterEach(func() {
+		os.Remove(reportPath)
+	})
+
+	It("runs the cases of the suites with the config", func() {
+		run("fixtures/tests/suite.yml")
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).Should(gbytes.Say("PASS smuggler.yml: check returns the current version"))
+		Ω(session.Out).Should(gbytes.Say("PASS smuggler.yml: out fails without input"))
+		Ω(session.Out).Should(gbytes.Say("4 passed, 0 failed"))
+
+		report, err := ioutil.ReadFile(reportPath)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(report)).Should(ContainSubstring(`<testsuite name="smuggler.yml" tests="4" failures="0"`))
+	})
+
+	It("reports the failures", func() {
+		run("fixtures/tests/suite.yml", "fixtures/tests/failing.yml")
+		Expect(session.ExitCode()).To(Equal(1))
+		Ω(session.Out).Should(gbytes.Say("FAIL failing: check #1"))
+		Ω(session.Out).Should(gbytes.Say(`expected stderr to match 'never printed'`))
+		Ω(session.Out).Should(gbytes.Say(`expected versions \[{"ID":"2.0"}\], got \[{"ID":"1.0"}\]`))
+		Ω(session.Out).Should(gbytes.Say("4 passed, 1 failed"))
+
+		report, err := ioutil.ReadFile(reportPath)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(report)).Should(ContainSubstring(`<testsuite name="failing" tests="1" failures="1"`))
+	})
+})
+
+var _ = Describe("SMUGGLER_RECORD_DIR and smuggler replay", func() {
+	var recordDir, dataDir, recordingPath string
+
+	BeforeEach(func() {
+		recordDir, err = ioutil.TempDir("", "smuggler-record")
+		Ω(err).ShouldNot(HaveOccurred())
+		dataDir, err = ioutil.TempDir("", "smuggler-sources")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(os.MkdirAll(filepath.Join(dataDir, "input"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(dataDir, "input", "file"), []byte("content"), 0644)).Should(Succeed())
+
+		command := exec.Command(outPath, dataDir)
+		command.Stdin = bytes.NewBufferString(getJsonRequest(OutType, "recorded"))
+		command.Env = append(os.Environ(),
+			"SMUGGLER_LOG="+filepath.Join(recordDir, "smuggler.log"),
+			"SMUGGLER_RECORD_DIR="+filepath.Join(recordDir, "recordings"),
+			"SOME_TOKEN=secret",
+			"BUILD_ID=42",
+		)
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-session.Exited
+		Expect(session.ExitCode()).To(Equal(0))
+
+		recordings, err := filepath.Glob(filepath.Join(recordDir, "recordings", "*-out.json"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(recordings).Should(HaveLen(1))
+		recordingPath = recordings[0]
+	})
+	AfterEach(func() {
+		os.RemoveAll(recordDir)
+		os.RemoveAll(dataDir)
+	})
+
+	replay := func() *gexec.Session {
+		command := exec.Command(smugglerPath, "replay", recordingPath)
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-session.Exited
+		return session
+	}
+
+	It("records the invocation with the environment redacted", func() {
+		recording, err := LoadRecording(recordingPath)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(recording.Action).Should(Equal(OutType))
+		Ω(recording.Args).Should(Equal([]string{outPath, dataDir}))
+		Ω(recording.Env).Should(ContainElement("SOME_TOKEN=***"))
+		Ω(recording.Env).Should(ContainElement("BUILD_ID=42"))
+		Ω(string(recording.Request)).ShouldNot(ContainSubstring("a_secret"))
+		var request RawResourceRequest
+		Ω(json.Unmarshal(recording.Request, &request)).Should(Succeed())
+		Ω(request.Source).Should(HaveKeyWithValue("api_token", "***"))
+		Ω(request.Source).Should(HaveKeyWithValue("nested", map[string]interface{}{
+			"list": []interface{}{"***", "***"},
+		}))
+		Ω(request.Source).Should(HaveKey("commands"))
+		Ω(request.Source["commands"]).Should(HaveKeyWithValue("out", ContainSubstring("test -f")))
+		Ω(recording.InputFiles).Should(Equal([]string{"input/", "input/file"}))
+		Ω(recording.Response).Should(MatchJSON(`{"version":{"ID":"42"}}`))
+		Ω(recording.ExitStatus).Should(Equal(0))
+	})
+
+	It("replays it with the same response", func() {
+		session := replay()
+		Expect(session.ExitCode()).To(Equal(0))
+		Ω(string(session.Out.Contents())).Should(ContainSubstring("OK   " + recordingPath))
+	})
+
+	It("reports when the response differs", func() {
+		recording, err := LoadRecording(recordingPath)
+		Ω(err).ShouldNot(HaveOccurred())
+		recording.Response = []byte(`{"version":{"ID":"41"}}`)
+		b, err := json.Marshal(recording)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.WriteFile(recordingPath, b, 0644)).Should(Succeed())
+
+		session := replay()
+		Expect(session.ExitCode()).To(Equal(1))
+		Ω(string(session.Out.Contents())).Should(ContainSubstring("DIFF " + recordingPath))
+		Ω(session.Out).Should(gbytes.Say(`recorded: exit status 0, response {"version":{"ID":"41"}}`))
+		Ω(session.Out).Should(gbytes.Say(`replayed: exit status 0, response {"version":{"ID":"42"}`))
+		Ω(session.Out).Should(gbytes.Say(`diff \(- recorded, \+ replayed\):\n`))
+		Ω(session.Out).Should(gbytes.Say(`      exit status 0\n`))
+		Ω(session.Out).Should(gbytes.Say(`      {\n`))
+		Ω(session.Out).Should(gbytes.Say(`      "version": {\n`))
+		Ω(session.Out).Should(gbytes.Say(`    -     "ID": "41"\n`))
+		Ω(session.Out).Should(gbytes.Say(`    \+     "ID": "42"\n`))
+	})
+})
+
 func getJsonRequest(t RequestType, resourceName string) string {
 	jsonRequest, err := pipeline.JsonRequest(t, resourceName, "a_job", "1.2.3")
 	Ω(err).ShouldNot(HaveOccurred())
@@ -12,14 +12,16 @@ import (
 	"testing"
 )
 
+var smugglerPath string
 var checkPath string
 var inPath string
 var outPath string
 
 type suiteData struct {
-	CheckPath string
-	InPath    string
-	OutPath   string
+	SmugglerPath string
+	CheckPath    string
+	InPath       string
+	OutPath      string
 }
 
 var _ = SynchronizedBeforeSuite(func() []byte {
@@ -37,9 +39,10 @@ var _ = SynchronizedBeforeSuite(func() []byte {
 	Ω(err).ShouldNot(HaveOccurred())
 
 	data, err := json.Marshal(suiteData{
-		CheckPath: cp,
-		InPath:    ip,
-		OutPath:   op,
+		SmugglerPath: gp,
+		CheckPath:    cp,
+		InPath:       ip,
+		OutPath:      op,
 	})
 	Ω(err).ShouldNot(HaveOccurred())
 
@@ -50,6 +53,7 @@ var _ = SynchronizedBeforeSuite(func() []byte {
 	err := json.Unmarshal(data, &sd)
 	Ω(err).ShouldNot(HaveOccurred())
 
+	smugglerPath = sd.SmugglerPath
 	checkPath = sd.CheckPath
 	inPath = sd.InPath
 	outPath = sd.OutPath
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+	"github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+// `smuggler test`: Runs the test cases of the YAML suites against this
+// smuggler binary and its config
+func testMain(args []string) {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	junitPath := flags.String("junit", "", "Write a JUnit XML report to this file")
+	flags.Usage = func() {
+		utils.Sayf("usage: %s test [-junit <file>] <suite.yml>...\n\n", os.Args[0])
+		utils.Sayf("Runs the test cases of the suites.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		utils.Fatal("finding the smuggler binary", err, 1)
+	}
+
+	var results []smuggler.TestResult
+	for _, path := range flags.Args() {
+		suite, err := smuggler.LoadTestSuite(path)
+		if err != nil {
+			utils.Fatal("loading test suite", err, 1)
+		}
+		results = append(results, suite.Run(binary)...)
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Passed() {
+			fmt.Printf("PASS %s: %s (%.3fs)\n", r.Suite, r.Case, r.Duration.Seconds())
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL %s: %s (%.3fs)\n", r.Suite, r.Case, r.Duration.Seconds())
+		for _, f := range r.Failures {
+			fmt.Printf("    %s\n", f)
+		}
+	}
+	fmt.Printf("\n%d passed, %d failed\n", len(results)-failed, failed)
+
+	if *junitPath != "" {
+		if err := writeJUnitReport(*junitPath, results); err != nil {
+			utils.Fatal("writing report", err, 1)
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func writeJUnitReport(path string, results []smuggler.TestResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := smuggler.WriteJUnitReport(f, results); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}